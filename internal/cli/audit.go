@@ -0,0 +1,209 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cli
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/eraclitux/ecsundo/internal/platform/aws"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+)
+
+const auditFile = ".ecsundo.audit.jsonl"
+
+// auditSinkTimeout is the maximum time to ship audit entries to the sink.
+var auditSinkTimeout = 10 * time.Second
+
+// auditEntry records who made a service change, from where and with which
+// result. Changes of a single invocation share the same run.
+type auditEntry struct {
+	Run               string    `json:"run"`
+	Time              time.Time `json:"time"`
+	Identity          string    `json:"identity"`
+	Host              string    `json:"host"`
+	Command           string    `json:"command"`
+	Region            string    `json:"region"`
+	Cluster           string    `json:"cluster"`
+	Service           string    `json:"service,omitempty"`
+	FromTaskARN       string    `json:"from_task_arn,omitempty"`
+	ToTaskARN         string    `json:"to_task_arn,omitempty"`
+	RegisteredTaskARN string    `json:"registered_task_arn,omitempty"`
+	// Compensation marks changes restoring services after an atomic
+	// rollback failed.
+	Compensation bool `json:"compensation,omitempty"`
+	// Result is ok for every change made, error for every service that
+	// failed or, if the failure does not concern single services, for the
+	// whole invocation.
+	Result     string `json:"result"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// auditPath returns the path of the audit log, it can be set with the
+// audit.path configuration key.
+func auditPath() (string, error) {
+	if path := viper.GetString("audit.path"); path != "" {
+		return path, nil
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, auditFile), nil
+}
+
+// auditEntries returns the audit entries for changes made on a cluster since
+// started: one for every change and, if err is not nil, one for every
+// service that failed or, if err does not report them, one for the whole
+// invocation, for serviceName if the failure concerns a single service.
+func auditEntries(ecs ecsProvider, clusterName, serviceName string, started time.Time, changes []aws.ServiceChange, err error) []auditEntry {
+	now := time.Now().UTC()
+	identity, idErr := ecs.CallerIdentity()
+	if idErr != nil {
+		identity = "unknown"
+		fmt.Fprintln(os.Stderr, "unable to get caller identity for audit log:", idErr)
+	}
+	host, _ := os.Hostname()
+	run := make([]byte, 8)
+	rand.Read(run)
+	base := auditEntry{
+		Run:      hex.EncodeToString(run),
+		Time:     now,
+		Identity: identity,
+		Host:     host,
+		Command:  strings.Join(os.Args, " "),
+		Region:   ecs.Region(),
+		Cluster:  clusterName,
+		Result:   "ok",
+	}
+	changeEntry := func(change aws.ServiceChange) auditEntry {
+		entry := base
+		entry.Service = change.ARN
+		entry.FromTaskARN = change.FromTaskARN
+		entry.ToTaskARN = change.ToTaskARN
+		entry.RegisteredTaskARN = change.RegisteredTaskARN
+		entry.Compensation = change.Compensation
+		entry.DurationMS = durationMS(change.Duration)
+		return entry
+	}
+	var failures []aws.ServiceFailure
+	if rbErr, ok := err.(*aws.RollbackError); ok {
+		failures = rbErr.Failures
+	}
+	// A change that failed its health check is reported by its failure.
+	failed := make(map[aws.ServiceChange]bool, len(failures))
+	for _, failure := range failures {
+		failed[failure.ServiceChange] = true
+	}
+	entries := make([]auditEntry, 0, len(changes)+len(failures)+1)
+	for _, change := range changes {
+		if !failed[change] {
+			entries = append(entries, changeEntry(change))
+		}
+	}
+	for _, failure := range failures {
+		entry := changeEntry(failure.ServiceChange)
+		entry.Result = "error"
+		entry.Error = failure.Err.Error()
+		entries = append(entries, entry)
+	}
+	if err != nil && len(failures) == 0 {
+		entry := base
+		entry.Service = serviceName
+		entry.Result = "error"
+		entry.Error = err.Error()
+		entry.DurationMS = durationMS(now.Sub(started))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// durationMS returns d in milliseconds.
+func durationMS(d time.Duration) int64 {
+	return d.Nanoseconds() / int64(time.Millisecond)
+}
+
+// auditChanges appends changes made on a cluster since started, and err if
+// not nil, to the audit log and ships them to the sink set with the
+// audit.sink configuration key. Failures are reported without stopping the
+// command.
+func auditChanges(ecs ecsProvider, clusterName, serviceName string, started time.Time, changes []aws.ServiceChange, err error) {
+	if len(changes) == 0 && err == nil {
+		return
+	}
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	for _, entry := range auditEntries(ecs, clusterName, serviceName, started, changes, err) {
+		if err := encoder.Encode(entry); err != nil {
+			fmt.Fprintln(os.Stderr, "unable to write audit log:", err)
+			return
+		}
+	}
+	if err := appendAudit(data.Bytes()); err != nil {
+		fmt.Fprintln(os.Stderr, "unable to write audit log:", err)
+	}
+	if sink := viper.GetString("audit.sink"); sink != "" {
+		if err := shipAudit(sink, data.Bytes()); err != nil {
+			fmt.Fprintln(os.Stderr, "unable to ship audit log:", err)
+		}
+	}
+}
+
+// appendAudit appends JSON Lines entries to the audit log.
+func appendAudit(data []byte) error {
+	path, err := auditPath()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// shipAudit posts JSON Lines entries to an HTTP endpoint.
+func shipAudit(sink string, data []byte) error {
+	client := &http.Client{Timeout: auditSinkTimeout}
+	resp, err := client.Post(sink, "application/x-ndjson", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded %s", sink, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cli
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/eraclitux/ecsundo/internal/mock"
+	"github.com/eraclitux/ecsundo/internal/platform/aws"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func TestServiceRollbackAudit(t *testing.T) {
+	clusterName := "my-cluster-under-test-audit"
+	serviceName := "my-service-under-test"
+	var shipped []byte
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		shipped, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer sink.Close()
+	viper.Set("audit.sink", sink.URL)
+	defer viper.Set("audit.sink", "")
+	ecsService := &mock.ECSService{}
+	serviceCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeServiceRunE(ecsService)
+		return nil
+	}
+	defer serviceCmd.Flags().Set("revision", "0")
+	rootCmd.SetArgs([]string{"service", "-c", clusterName, "--revision", "3", serviceName})
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatal("running Execute():", err)
+	}
+	f, err := os.Open(viper.GetString("audit.path"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entry auditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Cluster == clusterName {
+			entry = e
+		}
+	}
+	if entry.Service != serviceName || entry.ToTaskARN != ecsService.Version || entry.Result != "ok" {
+		t.Fatal("wrong audit entry:", entry)
+	}
+	if entry.Identity != "arn:aws:iam::123456789012:user/tester" || entry.Host == "" || entry.Command == "" {
+		t.Fatal("caller not audited:", entry)
+	}
+	var shippedEntry auditEntry
+	if err := json.Unmarshal(shipped, &shippedEntry); err != nil {
+		t.Fatal("audit not shipped:", err)
+	}
+	if shippedEntry != entry {
+		t.Fatal("wrong shipped entry:", shippedEntry)
+	}
+}
+
+func Test_auditEntriesFailures(t *testing.T) {
+	ecsService := &mock.ECSService{}
+	api := aws.ServiceChange{ARN: "api", FromTaskARN: "api:2", ToTaskARN: "api:1", Duration: 2 * time.Second}
+	restored := aws.ServiceChange{ARN: "api", FromTaskARN: "api:1", ToTaskARN: "api:2", Compensation: true, Duration: time.Second}
+	worker := aws.ServiceChange{ARN: "worker", FromTaskARN: "worker:7", ToTaskARN: "worker:6", Duration: 3 * time.Second}
+	err := &aws.RollbackError{
+		Failures: []aws.ServiceFailure{{ServiceChange: worker, Err: errors.New("update refused")}},
+		Err:      errors.New("rollback failed"),
+	}
+	started := time.Now().Add(-time.Minute)
+	entries := auditEntries(ecsService, "my-cluster", "", started, []aws.ServiceChange{api, restored}, err)
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3: %+v", len(entries), entries)
+	}
+	tests := []struct {
+		service      string
+		result       string
+		compensation bool
+		durationMS   int64
+	}{
+		{"api", "ok", false, 2000},
+		{"api", "ok", true, 1000},
+		{"worker", "error", false, 3000},
+	}
+	for i, tt := range tests {
+		entry := entries[i]
+		if entry.Service != tt.service || entry.Result != tt.result || entry.Compensation != tt.compensation || entry.DurationMS != tt.durationMS {
+			t.Errorf("entries[%d] = %+v", i, entry)
+		}
+		if entry.Run != entries[0].Run || len(entry.Run) != 16 {
+			t.Errorf("entries[%d]: wrong run %q", i, entry.Run)
+		}
+	}
+	if entries[2].FromTaskARN != "worker:7" || entries[2].ToTaskARN != "worker:6" || entries[2].Error != "update refused" {
+		t.Errorf("wrong failure entry: %+v", entries[2])
+	}
+}
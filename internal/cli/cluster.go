@@ -21,12 +21,16 @@
 package cli
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/eraclitux/ecsundo/internal/platform/aws"
 	homedir "github.com/mitchellh/go-homedir"
@@ -39,6 +43,253 @@ const (
 	fileSuffix     = ".ecsundo"
 )
 
+// writeSnapshot writes the versions of services to a snapshot file.
+func writeSnapshot(filePath string, servicesInfo []aws.ServiceInfo) error {
+	var snapshotData bytes.Buffer
+	for _, serviceInfo := range servicesInfo {
+		fmt.Fprintf(&snapshotData, "%s%s%s\n", serviceInfo.ARN, separatorConst, serviceInfo.TaskARN)
+	}
+	return ioutil.WriteFile(filePath, snapshotData.Bytes(), 0640)
+}
+
+// readSnapshot reads the versions of services from a snapshot file.
+func readSnapshot(filePath string) ([]aws.ServiceInfo, error) {
+	bb, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(bb)
+	servicesInfo := make([]aws.ServiceInfo, 0)
+	for buf.Len() > 0 {
+		line, err := buf.ReadString(byte('\n'))
+		if err != nil {
+			return nil, err
+		}
+		ss := strings.Split(line, separatorConst)
+		if len(ss) < 2 {
+			return nil, errors.New("invalid snapshot format")
+		}
+		servicesInfo = append(
+			servicesInfo,
+			aws.ServiceInfo{
+				ARN:     strings.TrimRight(ss[0], "\n"),
+				TaskARN: strings.TrimRight(ss[1], "\n"),
+			},
+		)
+	}
+	return servicesInfo, nil
+}
+
+// parseKeyValues parses a list of key=value pairs.
+func parseKeyValues(pairs []string) (map[string]string, error) {
+	m := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		ss := strings.SplitN(pair, "=", 2)
+		if len(ss) < 2 || ss[0] == "" || ss[1] == "" {
+			return nil, fmt.Errorf("invalid %q, must be in the form key=value", pair)
+		}
+		m[ss[0]] = ss[1]
+	}
+	return m, nil
+}
+
+// barrierOptions sets in opts the barriers listed in configuration and
+// whether --allow-barrier lets services be rolled back past them.
+func barrierOptions(cmd *cobra.Command, opts *aws.RollbackOptions) error {
+	allowBarrier, err := cmd.Flags().GetBool("allow-barrier")
+	if err != nil {
+		return err
+	}
+	opts.AllowBarrier = allowBarrier
+	opts.Barriers = viper.GetStringSlice("barriers")
+	return nil
+}
+
+// serviceFilter returns the filter selecting services from command flags
+// and from the exclude list in configuration.
+func serviceFilter(cmd *cobra.Command) (aws.ServiceFilter, error) {
+	include, err := cmd.Flags().GetStringArray("include")
+	if err != nil {
+		return aws.ServiceFilter{}, err
+	}
+	exclude, err := cmd.Flags().GetStringArray("exclude")
+	if err != nil {
+		return aws.ServiceFilter{}, err
+	}
+	tagPairs, err := cmd.Flags().GetStringArray("tag")
+	if err != nil {
+		return aws.ServiceFilter{}, err
+	}
+	tags, err := parseKeyValues(tagPairs)
+	if err != nil {
+		return aws.ServiceFilter{}, err
+	}
+	return aws.ServiceFilter{
+		Include: include,
+		Exclude: append(exclude, viper.GetStringSlice("exclude")...),
+		Tags:    tags,
+	}, nil
+}
+
+// parseAt parses a time given as RFC3339 or as a duration before now.
+func parseAt(at string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, at); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(at)
+	if err != nil || d < 0 {
+		return time.Time{}, fmt.Errorf("invalid time %q, use RFC3339 or a duration like 2h30m", at)
+	}
+	return now.Add(-d), nil
+}
+
+// rolloutOptions returns options setting how changes are applied to the
+// services of a cluster: in waves, from flags and groups in configuration,
+// in order of dependencies, checking load balancer targets, optionally
+// waiting for services to be stable between waves and compensating failures.
+func rolloutOptions(cmd *cobra.Command, ecs ecsProvider, clusterName string) (aws.RollbackOptions, error) {
+	timeout, err := healthTimeout(cmd)
+	if err != nil {
+		return aws.RollbackOptions{}, err
+	}
+	batchSize, err := cmd.Flags().GetInt("batch-size")
+	if err != nil {
+		return aws.RollbackOptions{}, err
+	}
+	if batchSize < 0 {
+		return aws.RollbackOptions{}, errors.New("batch size cannot be negative")
+	}
+	waveDelay, err := cmd.Flags().GetDuration("wave-delay")
+	if err != nil {
+		return aws.RollbackOptions{}, err
+	}
+	var groups []aws.ServiceGroup
+	if err := viper.UnmarshalKey("groups", &groups); err != nil {
+		return aws.RollbackOptions{}, fmt.Errorf("invalid groups in configuration: %s", err)
+	}
+	wait, err := cmd.Flags().GetBool("wait")
+	if err != nil {
+		return aws.RollbackOptions{}, err
+	}
+	atomic, err := cmd.Flags().GetBool("atomic")
+	if err != nil {
+		return aws.RollbackOptions{}, err
+	}
+	waitTimeout, err := cmd.Flags().GetDuration("timeout")
+	if err != nil {
+		return aws.RollbackOptions{}, err
+	}
+	out := cmd.OutOrStdout()
+	opts := aws.RollbackOptions{
+		HealthTimeout: timeout,
+		Groups:        groups,
+		BatchSize:     batchSize,
+		WaveDelay:     waveDelay,
+		DependsOn:     viper.GetStringMapStringSlice("dependsOn"),
+		WaitWaves:     wait,
+		Atomic:        atomic,
+		WaitStable: func(changes []aws.ServiceChange) error {
+			return waitStable(ecs, clusterName, changedServices(changes), waitTimeout, out)
+		},
+	}
+	if err := deploymentOptions(cmd, ecs, clusterName, &opts); err != nil {
+		return aws.RollbackOptions{}, err
+	}
+	if err := barrierOptions(cmd, &opts); err != nil {
+		return aws.RollbackOptions{}, err
+	}
+	return opts, nil
+}
+
+// confirmChanges shows a summary of the changes restoring services would
+// make and asks user to confirm them typing the cluster name. Confirmation
+// is skipped with --yes, or with --non-interactive when stdin is not a
+// terminal.
+func confirmChanges(cmd *cobra.Command, ecs ecsProvider, clusterName string, servicesInfo []aws.ServiceInfo, opts aws.RollbackOptions) error {
+	yes, err := cmd.Flags().GetBool("yes")
+	if err != nil {
+		return err
+	}
+	nonInteractive, err := cmd.Flags().GetBool("non-interactive")
+	if err != nil {
+		return err
+	}
+	f, ok := stdin.(*os.File)
+	terminal := ok && isTerminal(f)
+	if yes || (nonInteractive && !terminal) {
+		return nil
+	}
+	plan, err := ecs.PlanRollback(servicesInfo, clusterName, opts)
+	if err != nil {
+		return fmt.Errorf("error for %q: %s", clusterName, err)
+	}
+	out := cmd.OutOrStdout()
+	fmt.Fprintf(out, "%d services in cluster %q (%s) will be changed:\n", len(plan), clusterName, ecs.Region())
+	if err := printPlan(out, plan); err != nil {
+		return err
+	}
+	fmt.Fprint(out, "type the cluster name to confirm: ")
+	answer, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		if !terminal {
+			return errors.New("confirmation required, use --yes or --non-interactive when stdin is not a terminal")
+		}
+		return errAborted
+	}
+	if strings.TrimSpace(answer) != clusterName {
+		return errAborted
+	}
+	return nil
+}
+
+// restoreServices updates services to the given versions, optionally
+// showing differences first, and records changes in the journal. Changes
+// are confirmed by user first if confirm is true.
+func restoreServices(cmd *cobra.Command, ecs ecsProvider, clusterName string, servicesInfo []aws.ServiceInfo, confirm bool) error {
+	showDiff, err := cmd.Flags().GetBool("show-diff")
+	if err != nil {
+		return err
+	}
+	if showDiff {
+		if err := showDiffs(ecs, clusterName, servicesInfo, cmd.OutOrStdout()); err != nil {
+			return err
+		}
+	}
+	opts, err := rolloutOptions(cmd, ecs, clusterName)
+	if err != nil {
+		return err
+	}
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		return showPlan(ecs, clusterName, servicesInfo, opts, cmd.OutOrStdout())
+	}
+	if confirm {
+		if err := confirmChanges(cmd, ecs, clusterName, servicesInfo, opts); err != nil {
+			return err
+		}
+	}
+	serviceNames := make([]string, 0, len(servicesInfo))
+	for _, serviceInfo := range servicesInfo {
+		serviceNames = append(serviceNames, serviceInfo.ARN)
+	}
+	if len(serviceNames) > 0 {
+		if err := safetySnapshot(cmd, ecs, clusterName, servicesSelector(serviceNames)); err != nil {
+			return err
+		}
+	}
+	started := time.Now()
+	changes, err := ecs.ClusterRestore(servicesInfo, clusterName, opts)
+	auditChanges(ecs, clusterName, "", started, changes, err)
+	err = journalChanges(clusterName, changes, err)
+	if err != nil {
+		return fmt.Errorf("error for %q: %s", clusterName, err)
+	}
+	return waitChanges(cmd, ecs, clusterName, changes)
+}
+
 func makeClusterRunE(ecs ecsProvider) func(cmd *cobra.Command, args []string) error {
 	return func(cmd *cobra.Command, args []string) error {
 		clusterName := viper.GetString("cluster")
@@ -50,13 +301,147 @@ func makeClusterRunE(ecs ecsProvider) func(cmd *cobra.Command, args []string) er
 		if len(args) > 0 {
 			clusterName = args[0]
 		}
+		unlock, err := lockCluster(cmd, ecs, clusterName)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		interactive, err := cmd.Flags().GetBool("interactive")
+		if err != nil {
+			return err
+		}
+		at, err := cmd.Flags().GetString("at")
+		if err != nil {
+			return err
+		}
+		imageTags, err := cmd.Flags().GetStringArray("image-tag")
+		if err != nil {
+			return err
+		}
+		images, err := parseKeyValues(imageTags)
+		if err != nil {
+			return err
+		}
+		steps, err := cmd.Flags().GetInt("steps")
+		if err != nil {
+			return err
+		}
+		if steps < 1 {
+			return errors.New("steps must be a positive number")
+		}
+		if (interactive || at != "") && (len(images) > 0 || steps > 1) {
+			return errors.New("--interactive and --at cannot be used with --image-tag or --steps")
+		}
+		if interactive && at != "" {
+			return errors.New("--interactive and --at cannot be used together")
+		}
+		showDiff, err := cmd.Flags().GetBool("show-diff")
+		if err != nil {
+			return err
+		}
+		dryRun, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			return err
+		}
+		yes, err := cmd.Flags().GetBool("yes")
+		if err != nil {
+			return err
+		}
+		filter, err := serviceFilter(cmd)
+		if err != nil {
+			return err
+		}
+		opts, err := rolloutOptions(cmd, ecs, clusterName)
+		if err != nil {
+			return err
+		}
+		opts.Images = images
+		opts.Steps = steps
+		opts.Filter = filter
+		var servicesInfo []aws.ServiceInfo
+		switch {
+		case interactive:
+			servicesInfo, err = pickClusterVersions(ecs, clusterName, filter, cmd.OutOrStdout())
+			if err != nil {
+				return err
+			}
+		case at != "":
+			t, err := parseAt(at, time.Now())
+			if err != nil {
+				return err
+			}
+			servicesInfo, err = clusterStateAt(ecs, clusterName, t, filter, cmd.OutOrStdout())
+			if err != nil {
+				return fmt.Errorf("error for %q: %s", clusterName, err)
+			}
+			if len(servicesInfo) == 0 {
+				fmt.Fprintf(cmd.OutOrStdout(), "all services already run the versions they had at %s\n", t.Format(time.RFC3339))
+				return nil
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "versions running at %s:\n", t.Format(time.RFC3339))
+			for _, serviceInfo := range servicesInfo {
+				fmt.Fprintf(cmd.OutOrStdout(), "  %s: %s\n", aws.ServiceName(serviceInfo.ARN), aws.TaskName(serviceInfo.TaskARN))
+			}
+		case showDiff || dryRun || !yes:
+			// Targets are resolved first to be shown before any change.
+			servicesInfo, err = ecs.ClusterTargets(clusterName, opts)
+			if err != nil {
+				return fmt.Errorf("error for %q: %s", clusterName, err)
+			}
+		default:
+			if err := safetySnapshot(cmd, ecs, clusterName, filter); err != nil {
+				return err
+			}
+			started := time.Now()
+			changes, err := ecs.ClusterRollback(clusterName, opts)
+			auditChanges(ecs, clusterName, "", started, changes, err)
+			err = journalChanges(clusterName, changes, err)
+			if err != nil {
+				return fmt.Errorf("error for %q: %s", clusterName, err)
+			}
+			return waitChanges(cmd, ecs, clusterName, changes)
+		}
+		// Versions chosen interactively have already been confirmed.
+		return restoreServices(cmd, ecs, clusterName, servicesInfo, !interactive)
+	}
+}
 
-		err := ecs.ClusterRollback(clusterName)
+// clusterStateAt returns the task versions services in a cluster selected by
+// filter were running at a given time. Services whose deployment history does not go back to it
+// are looked up in the journal, those still unknown are reported and left
+// out.
+func clusterStateAt(ecs ecsProvider, clusterName string, at time.Time, filter aws.ServiceFilter, w io.Writer) ([]aws.ServiceInfo, error) {
+	servicesInfo, skipped, err := ecs.ClusterStateAt(clusterName, at, filter)
+	if err != nil || len(skipped) == 0 {
+		return servicesInfo, err
+	}
+	entries, err := readJournal()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read journal: %s", err)
+	}
+	found, skipped := journalStateAt(entries, clusterName, skipped, at)
+	if len(found) > 0 {
+		current, err := ecs.ClusterSnapshot(clusterName)
 		if err != nil {
-			return fmt.Errorf("error for %q: %s", clusterName, err)
+			return nil, err
+		}
+		running := make(map[string]string, len(current))
+		for _, serviceInfo := range current {
+			running[serviceInfo.ARN] = serviceInfo.TaskARN
+		}
+		for _, serviceInfo := range found {
+			if running[serviceInfo.ARN] != serviceInfo.TaskARN {
+				servicesInfo = append(servicesInfo, serviceInfo)
+			}
+		}
+	}
+	if len(skipped) > 0 {
+		fmt.Fprintf(w, "unable to find versions running at %s, skipped:\n", at.Format(time.RFC3339))
+		for _, serviceARN := range skipped {
+			fmt.Fprintf(w, "  %s\n", aws.ServiceName(serviceARN))
 		}
-		return nil
 	}
+	return servicesInfo, nil
 }
 
 func makeSnapshotRunE(ecs ecsProvider) func(cmd *cobra.Command, args []string) error {
@@ -81,15 +466,18 @@ func makeSnapshotRunE(ecs ecsProvider) func(cmd *cobra.Command, args []string) e
 			}
 			filePath = filepath.Join(home, "."+clusterName+fileSuffix)
 		}
+		filter, err := serviceFilter(cmd)
+		if err != nil {
+			return err
+		}
 		serviceVersions, err := ecs.ClusterSnapshot(clusterName)
+		if err == nil {
+			serviceVersions, err = ecs.FilterServices(serviceVersions, clusterName, filter)
+		}
 		if err != nil {
 			return fmt.Errorf("error for %q: %s", clusterName, err)
 		}
-		var snapshotData bytes.Buffer
-		for _, serviceInfo := range serviceVersions {
-			fmt.Fprintf(&snapshotData, "%s%s%s\n", serviceInfo.ARN, separatorConst, serviceInfo.TaskARN)
-		}
-		return ioutil.WriteFile(filePath, snapshotData.Bytes(), 0640)
+		return writeSnapshot(filePath, serviceVersions)
 	}
 }
 
@@ -104,6 +492,11 @@ func makeRestoreRunE(ecs ecsProvider) func(cmd *cobra.Command, args []string) er
 		if len(args) > 0 {
 			clusterName = args[0]
 		}
+		unlock, err := lockCluster(cmd, ecs, clusterName)
+		if err != nil {
+			return err
+		}
+		defer unlock()
 		filePath, err := cmd.Flags().GetString("snapshot-path")
 		if err != nil {
 			return err
@@ -115,34 +508,19 @@ func makeRestoreRunE(ecs ecsProvider) func(cmd *cobra.Command, args []string) er
 			}
 			filePath = filepath.Join(home, "."+clusterName+fileSuffix)
 		}
-		bb, err := ioutil.ReadFile(filePath)
+		servicesInfo, err := readSnapshot(filePath)
 		if err != nil {
 			return err
 		}
-		buf := bytes.NewBuffer(bb)
-		servicesInfo := make([]aws.ServiceInfo, 0)
-		for buf.Len() > 0 {
-			line, err := buf.ReadString(byte('\n'))
-			if err != nil {
-				return err
-			}
-			ss := strings.Split(line, separatorConst)
-			if len(ss) < 2 {
-				return errors.New("invalid snapshot format")
-			}
-			servicesInfo = append(
-				servicesInfo,
-				aws.ServiceInfo{
-					ARN:     strings.TrimRight(ss[0], "\n"),
-					TaskARN: strings.TrimRight(ss[1], "\n"),
-				},
-			)
+		filter, err := serviceFilter(cmd)
+		if err != nil {
+			return err
 		}
-		err = ecs.ClusterRestore(servicesInfo, clusterName)
+		servicesInfo, err = ecs.FilterServices(servicesInfo, clusterName, filter)
 		if err != nil {
 			return fmt.Errorf("error for %q: %s", clusterName, err)
 		}
-		return nil
+		return restoreServices(cmd, ecs, clusterName, servicesInfo, true)
 	}
 }
 
@@ -152,11 +530,11 @@ var clusterCmd = &cobra.Command{
 	Short: "Rollback all services in a given cluster",
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 		// This hook helps to inject runtime parameters to ecsProvider.
-		verbose, err := cmd.Flags().GetBool("verbose")
+		ecs, err := ecsClient(cmd)
 		if err != nil {
 			return err
 		}
-		cmd.RunE = makeClusterRunE(aws.NewECSClient(verbose))
+		cmd.RunE = makeClusterRunE(ecs)
 		return nil
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
@@ -171,11 +549,11 @@ var snapshotCmd = &cobra.Command{
 	Short: "Save current task versions for all services",
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 		// This hook helps to inject runtime parameters to ecsProvider.
-		verbose, err := cmd.Flags().GetBool("verbose")
+		ecs, err := ecsClient(cmd)
 		if err != nil {
 			return err
 		}
-		cmd.RunE = makeSnapshotRunE(aws.NewECSClient(verbose))
+		cmd.RunE = makeSnapshotRunE(ecs)
 		return nil
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
@@ -190,11 +568,11 @@ var restoreCmd = &cobra.Command{
 	Short: "Restore all services to the versions from the snapshot",
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 		// This hook helps to inject runtime parameters to ecsProvider.
-		verbose, err := cmd.Flags().GetBool("verbose")
+		ecs, err := ecsClient(cmd)
 		if err != nil {
 			return err
 		}
-		cmd.RunE = makeRestoreRunE(aws.NewECSClient(verbose))
+		cmd.RunE = makeRestoreRunE(ecs)
 		return nil
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
@@ -204,8 +582,22 @@ var restoreCmd = &cobra.Command{
 }
 
 func init() {
+	clusterCmd.PersistentFlags().StringArray("include", nil, "Select only services with name matching this glob or /regexp/ (can be repeated)")
+	clusterCmd.PersistentFlags().StringArray("exclude", nil, "Skip services with name matching this glob or /regexp/ (can be repeated)")
+	clusterCmd.PersistentFlags().Int("batch-size", 0, "Maximum number of services changed at the same time, 0 changes all of them at once")
+	clusterCmd.PersistentFlags().Duration("wave-delay", 0, "Time to wait between waves of services")
+	clusterCmd.PersistentFlags().Bool("atomic", false, "If any service fails, restore changed services to their original versions")
+	clusterCmd.PersistentFlags().BoolP("yes", "y", false, "Do not ask to confirm changes")
+	clusterCmd.PersistentFlags().Bool("non-interactive", false, "Do not ask to confirm changes when stdin is not a terminal")
+	clusterCmd.PersistentFlags().StringArray("tag", nil, "Select only services with this tag, in the form key=value (can be repeated)")
+	clusterCmd.Flags().BoolP("interactive", "i", false, "Choose versions to rollback to from a list")
+	clusterCmd.Flags().Int("steps", 1, "Number of deployed versions to go back for every service")
+	clusterCmd.Flags().StringArray("image-tag", nil, "Rollback a service to the version running this image, in the form <service-name>=<tag|digest> (can be repeated)")
+	clusterCmd.Flags().String("at", "", "Restore services to the versions running at this time (RFC3339 or duration before now, e.g. 2h)")
+	clusterCmd.Flags().Bool("show-diff", false, "Show changes between current and target task definitions")
 	snapshotCmd.Flags().StringP("snapshot-path", "s", "", "Path to snapshot file (default $HOME/.<cluster-name>.ecsundo)")
 	restoreCmd.Flags().StringP("snapshot-path", "s", "", "Path to snapshot file (default $HOME/.<cluster-name>.ecsundo)")
+	restoreCmd.Flags().Bool("show-diff", false, "Show changes between current and snapshot task definitions")
 	clusterCmd.AddCommand(snapshotCmd)
 	clusterCmd.AddCommand(restoreCmd)
 	rootCmd.AddCommand(clusterCmd)
@@ -21,16 +21,26 @@
 package cli
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/eraclitux/ecsundo/internal/mock"
+	"github.com/eraclitux/ecsundo/internal/platform/aws"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 func TestClusterRollback(t *testing.T) {
 	clusterName := "my-cluster-under-test-b"
 	ecsService := &mock.ECSService{}
-	rootCmd.SetArgs([]string{"cluster", clusterName})
+	rootCmd.SetArgs([]string{"cluster", "--yes", clusterName})
+	defer clusterCmd.Flags().Set("yes", "false")
 	clusterCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
 		cmd.RunE = makeClusterRunE(ecsService)
 		return nil
@@ -44,3 +54,367 @@ func TestClusterRollback(t *testing.T) {
 		t.Fatal("wrong clusterName:", ecsService.ClusterName)
 	}
 }
+
+// resetStringArray resets a string array flag, otherwise values keep being
+// appended across executions of the command.
+func resetStringArray(cmd *cobra.Command, name string) {
+	fresh := &cobra.Command{}
+	fresh.Flags().StringArray(name, nil, "")
+	flag := cmd.Flags().Lookup(name)
+	flag.Value = fresh.Flags().Lookup(name).Value
+	flag.Changed = false
+}
+
+func TestClusterRollbackImageTag(t *testing.T) {
+	clusterName := "my-cluster-under-test-b"
+	ecsService := &mock.ECSService{}
+	rootCmd.SetArgs([]string{"cluster", "--yes", "--image-tag", "my-service=abc123", clusterName})
+	defer clusterCmd.Flags().Set("yes", "false")
+	clusterCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeClusterRunE(ecsService)
+		return nil
+	}
+	defer resetStringArray(clusterCmd, "image-tag")
+	err := rootCmd.Execute()
+	if err != nil {
+		t.Log("running Execute():", err)
+		t.FailNow()
+	}
+	if ecsService.Options.Images["my-service"] != "abc123" {
+		t.Fatal("wrong images:", ecsService.Options.Images)
+	}
+}
+
+func TestClusterRollbackAt(t *testing.T) {
+	clusterName := "my-cluster-under-test-b"
+	ecsService := &mock.ECSService{}
+	rootCmd.SetArgs([]string{"cluster", "--yes", "--at", "2018-12-01T14:00:00Z", clusterName})
+	defer clusterCmd.Flags().Set("yes", "false")
+	rootCmd.SetOutput(ioutil.Discard)
+	defer rootCmd.SetOutput(nil)
+	clusterCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeClusterRunE(ecsService)
+		return nil
+	}
+	defer clusterCmd.Flags().Set("at", "")
+	err := rootCmd.Execute()
+	if err != nil {
+		t.Log("running Execute():", err)
+		t.FailNow()
+	}
+	if !ecsService.At.Equal(time.Date(2018, 12, 1, 14, 0, 0, 0, time.UTC)) {
+		t.Fatal("wrong time:", ecsService.At)
+	}
+	if len(ecsService.Restored) != 1 || ecsService.Restored[0].TaskARN != "task-a:1" {
+		t.Fatal("wrong restored services:", ecsService.Restored)
+	}
+}
+
+func TestClusterRollbackAtFilter(t *testing.T) {
+	clusterName := "my-cluster-under-test-b"
+	ecsService := &mock.ECSService{}
+	rootCmd.SetArgs([]string{"cluster", "--yes", "--at", "2h", "--include", "api-*", clusterName})
+	defer clusterCmd.Flags().Set("yes", "false")
+	rootCmd.SetOutput(ioutil.Discard)
+	defer rootCmd.SetOutput(nil)
+	clusterCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeClusterRunE(ecsService)
+		return nil
+	}
+	defer clusterCmd.Flags().Set("at", "")
+	defer resetStringArray(clusterCmd, "include")
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatal("running Execute():", err)
+	}
+	if len(ecsService.AtFilter.Include) != 1 || ecsService.AtFilter.Include[0] != "api-*" {
+		t.Fatal("filter not applied resolving versions:", ecsService.AtFilter)
+	}
+}
+
+func TestClusterRollbackAtSkipped(t *testing.T) {
+	clusterName := "my-cluster-under-test-b"
+	dir, err := ioutil.TempDir("", "ecsundo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer viper.Set("journal", viper.GetString("journal"))
+	viper.Set("journal", filepath.Join(dir, "journal"))
+	entry, err := json.Marshal(journalEntry{
+		Run:       "old",
+		Time:      time.Date(2018, 11, 30, 10, 0, 0, 0, time.UTC),
+		Cluster:   clusterName,
+		Service:   "arn:aws:ecs:us-east-1:123456789012:service/journaled",
+		ToTaskARN: "task-b:1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "journal"), append(entry, '\n'), 0640); err != nil {
+		t.Fatal(err)
+	}
+	ecsService := &mock.ECSService{
+		Skipped:  []string{"journaled", "unknown"},
+		Snapshot: []aws.ServiceInfo{{ARN: "journaled", TaskARN: "task-b:2"}},
+	}
+	rootCmd.SetArgs([]string{"cluster", "--yes", "--at", "2018-12-01T14:00:00Z", clusterName})
+	defer clusterCmd.Flags().Set("yes", "false")
+	var buf bytes.Buffer
+	rootCmd.SetOutput(&buf)
+	defer rootCmd.SetOutput(nil)
+	clusterCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeClusterRunE(ecsService)
+		return nil
+	}
+	defer clusterCmd.Flags().Set("at", "")
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatal("running Execute():", err)
+	}
+	if len(ecsService.Restored) != 2 || ecsService.Restored[1].TaskARN != "task-b:1" {
+		t.Fatal("wrong restored services:", ecsService.Restored)
+	}
+	if !strings.Contains(buf.String(), "skipped:\n  unknown\n") {
+		t.Fatal("skipped service not reported:", buf.String())
+	}
+}
+
+func Test_parseAt(t *testing.T) {
+	now := time.Date(2018, 12, 1, 16, 0, 0, 0, time.UTC)
+	tests := []struct {
+		at      string
+		want    time.Time
+		wantErr bool
+	}{
+		{at: "2018-12-01T14:00:00Z", want: time.Date(2018, 12, 1, 14, 0, 0, 0, time.UTC)},
+		{at: "90m", want: time.Date(2018, 12, 1, 14, 30, 0, 0, time.UTC)},
+		{at: "-1h", wantErr: true},
+		{at: "yesterday", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseAt(tt.at, now)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseAt(%q) error = %v, wantErr %v", tt.at, err, tt.wantErr)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseAt(%q) = %v, want %v", tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestClusterRollbackFilter(t *testing.T) {
+	clusterName := "my-cluster-under-test-b"
+	ecsService := &mock.ECSService{}
+	rootCmd.SetArgs([]string{"cluster", "--yes", "--include", "api-*", "--exclude", "/agent$/", "--tag", "team=payments", clusterName})
+	defer clusterCmd.Flags().Set("yes", "false")
+	clusterCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeClusterRunE(ecsService)
+		return nil
+	}
+	viper.Set("exclude", []string{"datadog"})
+	defer viper.Set("exclude", nil)
+	defer resetStringArray(clusterCmd, "include")
+	defer resetStringArray(clusterCmd, "exclude")
+	defer resetStringArray(clusterCmd, "tag")
+	err := rootCmd.Execute()
+	if err != nil {
+		t.Log("running Execute():", err)
+		t.FailNow()
+	}
+	filter := ecsService.Options.Filter
+	if len(filter.Include) != 1 || filter.Include[0] != "api-*" {
+		t.Fatal("wrong include:", filter.Include)
+	}
+	if len(filter.Exclude) != 2 || filter.Exclude[1] != "datadog" {
+		t.Fatal("wrong exclude:", filter.Exclude)
+	}
+	if filter.Tags["team"] != "payments" {
+		t.Fatal("wrong tags:", filter.Tags)
+	}
+}
+
+func TestClusterRollbackDryRun(t *testing.T) {
+	clusterName := "my-cluster-under-test-b"
+	ecsService := &mock.ECSService{}
+	var buf bytes.Buffer
+	rootCmd.SetOutput(&buf)
+	defer rootCmd.SetOutput(nil)
+	rootCmd.SetArgs([]string{"cluster", "--dry-run", clusterName})
+	clusterCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeClusterRunE(ecsService)
+		return nil
+	}
+	defer rootCmd.PersistentFlags().Set("dry-run", "false")
+	err := rootCmd.Execute()
+	if err != nil {
+		t.Fatal("running Execute():", err)
+	}
+	if ecsService.Restored != nil {
+		t.Fatal("services changed in dry run")
+	}
+	if len(ecsService.Planned) != 1 || ecsService.Planned[0].TaskARN != "task-a:1" {
+		t.Fatal("wrong plan:", ecsService.Planned)
+	}
+	if !strings.Contains(buf.String(), "my-service  app:2    app:1   yes") {
+		t.Fatal("wrong output:", buf.String())
+	}
+}
+
+func TestClusterRollbackConfirm(t *testing.T) {
+	clusterName := "my-cluster-under-test-b"
+	for _, test := range []struct {
+		answer  string
+		changed bool
+	}{
+		{clusterName + "\n", true},
+		{"other-cluster\n", false},
+	} {
+		ecsService := &mock.ECSService{}
+		var buf bytes.Buffer
+		rootCmd.SetOutput(&buf)
+		rootCmd.SetArgs([]string{"cluster", clusterName})
+		clusterCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+			cmd.RunE = makeClusterRunE(ecsService)
+			return nil
+		}
+		stdin = strings.NewReader(test.answer)
+		err := rootCmd.Execute()
+		stdin = os.Stdin
+		rootCmd.SetOutput(nil)
+		if !strings.Contains(buf.String(), "1 services in cluster \"my-cluster-under-test-b\" (us-east-1)") {
+			t.Fatal("missing summary:", buf.String())
+		}
+		if test.changed && (err != nil || len(ecsService.Restored) != 1) {
+			t.Fatal("services not changed after confirmation:", err)
+		}
+		if !test.changed && (err != errAborted || ecsService.Restored != nil) {
+			t.Fatal("services changed without confirmation:", err)
+		}
+	}
+}
+
+func TestClusterRollbackNonInteractive(t *testing.T) {
+	clusterName := "my-cluster-under-test-b"
+	ecsService := &mock.ECSService{}
+	rootCmd.SetArgs([]string{"cluster", "--non-interactive", clusterName})
+	clusterCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeClusterRunE(ecsService)
+		return nil
+	}
+	defer clusterCmd.Flags().Set("non-interactive", "false")
+	stdin = strings.NewReader("")
+	defer func() { stdin = os.Stdin }()
+	err := rootCmd.Execute()
+	if err != nil {
+		t.Fatal("running Execute():", err)
+	}
+	if len(ecsService.Restored) != 1 {
+		t.Fatal("services not changed:", ecsService.Restored)
+	}
+}
+
+func TestClusterRollbackWaves(t *testing.T) {
+	clusterName := "my-cluster-under-test-b"
+	ecsService := &mock.ECSService{}
+	rootCmd.SetArgs([]string{"cluster", "--yes", "--batch-size", "5", "--wave-delay", "30s", "--wait", clusterName})
+	defer clusterCmd.Flags().Set("yes", "false")
+	defer clusterCmd.Flags().Set("batch-size", "0")
+	defer clusterCmd.Flags().Set("wave-delay", "0s")
+	defer rootCmd.PersistentFlags().Set("wait", "false")
+	clusterCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeClusterRunE(ecsService)
+		return nil
+	}
+	viper.Set("groups", []map[string]interface{}{
+		{"name": "data", "services": []string{"db-*"}},
+		{"name": "backend", "services": []string{"api-*", "worker"}},
+	})
+	defer viper.Set("groups", nil)
+	viper.Set("dependsOn", map[string][]string{"web": {"api"}})
+	defer viper.Set("dependsOn", nil)
+	err := rootCmd.Execute()
+	if err != nil {
+		t.Fatal("running Execute():", err)
+	}
+	opts := ecsService.Options
+	if opts.BatchSize != 5 || opts.WaveDelay != 30*time.Second {
+		t.Fatal("wrong waves:", opts.BatchSize, opts.WaveDelay)
+	}
+	if len(opts.Groups) != 2 || opts.Groups[1].Name != "backend" || len(opts.Groups[1].Services) != 2 {
+		t.Fatal("wrong groups:", opts.Groups)
+	}
+	if len(opts.DependsOn["web"]) != 1 || opts.DependsOn["web"][0] != "api" {
+		t.Fatal("wrong dependencies:", opts.DependsOn)
+	}
+	if !opts.WaitWaves || opts.WaitStable == nil {
+		t.Fatal("services are not waited between waves")
+	}
+}
+
+func TestClusterRollbackAtomic(t *testing.T) {
+	clusterName := "my-cluster-under-test-b"
+	ecsService := &mock.ECSService{}
+	rootCmd.SetArgs([]string{"cluster", "--yes", "--atomic", clusterName})
+	defer clusterCmd.Flags().Set("yes", "false")
+	defer clusterCmd.Flags().Set("atomic", "false")
+	clusterCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeClusterRunE(ecsService)
+		return nil
+	}
+	err := rootCmd.Execute()
+	if err != nil {
+		t.Fatal("running Execute():", err)
+	}
+	if !ecsService.Options.Atomic {
+		t.Fatal("rollback is not atomic")
+	}
+}
+
+func TestClusterRollbackForce(t *testing.T) {
+	clusterName := "my-cluster-under-test-b"
+	ecsService := &mock.ECSService{}
+	rootCmd.SetArgs([]string{"cluster", "--yes", "--force", clusterName})
+	defer clusterCmd.Flags().Set("yes", "false")
+	defer rootCmd.PersistentFlags().Set("force", "false")
+	clusterCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeClusterRunE(ecsService)
+		return nil
+	}
+	err := rootCmd.Execute()
+	if err != nil {
+		t.Fatal("running Execute():", err)
+	}
+	if !ecsService.Options.Force || ecsService.Options.WaitDeployments != nil {
+		t.Fatal("wrong options:", ecsService.Options.Force)
+	}
+}
+
+func TestClusterRollbackBarrier(t *testing.T) {
+	clusterName := "my-cluster-under-test-b"
+	ecsService := &mock.ECSService{Barrier: "app:8"}
+	rootCmd.SetArgs([]string{"cluster", "--yes", clusterName})
+	defer clusterCmd.Flags().Set("yes", "false")
+	clusterCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeClusterRunE(ecsService)
+		return nil
+	}
+	viper.Set("barriers", []string{"app:8"})
+	defer viper.Set("barriers", nil)
+	err := rootCmd.Execute()
+	if err == nil || !strings.Contains(err.Error(), "app:8") {
+		t.Fatal("barrier not honoured:", err)
+	}
+	if ecsService.ClusterName != "" {
+		t.Fatal("cluster changed:", ecsService.ClusterName)
+	}
+
+	rootCmd.SetArgs([]string{"cluster", "--yes", "--allow-barrier", clusterName})
+	defer rootCmd.PersistentFlags().Set("allow-barrier", "false")
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatal("running Execute():", err)
+	}
+	opts := ecsService.Options
+	if !opts.AllowBarrier || len(opts.Barriers) != 1 || opts.Barriers[0] != "app:8" {
+		t.Fatal("wrong options:", opts.AllowBarrier, opts.Barriers)
+	}
+}
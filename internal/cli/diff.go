@@ -0,0 +1,161 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/eraclitux/ecsundo/internal/platform/aws"
+	"github.com/spf13/cobra"
+)
+
+const (
+	colorRed   = "\x1b[31m"
+	colorGreen = "\x1b[32m"
+	colorReset = "\x1b[0m"
+)
+
+// isTerminal reports whether w is a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// serviceDiffs compares current and target task definitions of services.
+func serviceDiffs(ecs ecsProvider, clusterName string, servicesInfo []aws.ServiceInfo) ([]aws.TaskDiff, error) {
+	diffs := make([]aws.TaskDiff, 0, len(servicesInfo))
+	for _, serviceInfo := range servicesInfo {
+		diff, err := ecs.ServiceDiff(serviceInfo.ARN, clusterName, serviceInfo.TaskARN)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %s", aws.ServiceName(serviceInfo.ARN), err)
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs, nil
+}
+
+// showDiffs prints differences between current and target task definitions
+// of services.
+func showDiffs(ecs ecsProvider, clusterName string, servicesInfo []aws.ServiceInfo, out io.Writer) error {
+	diffs, err := serviceDiffs(ecs, clusterName, servicesInfo)
+	if err != nil {
+		return err
+	}
+	printDiffs(out, diffs, isTerminal(out))
+	return nil
+}
+
+// printDiffs prints differences as text, colored if color is true.
+func printDiffs(out io.Writer, diffs []aws.TaskDiff, color bool) {
+	paint := func(c, s string) string {
+		if !color {
+			return s
+		}
+		return c + s + colorReset
+	}
+	for _, diff := range diffs {
+		fmt.Fprintf(out, "%s: %s -> %s\n", aws.ServiceName(diff.ServiceARN), aws.TaskName(diff.FromTaskARN), aws.TaskName(diff.ToTaskARN))
+		if len(diff.Changes) == 0 {
+			fmt.Fprintln(out, "  no changes")
+		}
+		for _, change := range diff.Changes {
+			fmt.Fprintf(out, "  %s\n", change.Field)
+			if change.From != "" {
+				fmt.Fprintln(out, paint(colorRed, "    - "+change.From))
+			}
+			if change.To != "" {
+				fmt.Fprintln(out, paint(colorGreen, "    + "+change.To))
+			}
+		}
+	}
+}
+
+func makeDiffRunE(ecs ecsProvider) func(cmd *cobra.Command, args []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		clusterName, err := serviceClusterName(cmd)
+		if err != nil {
+			return err
+		}
+		if len(args) <= 0 {
+			return errors.New("service name is mandatory")
+		}
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return err
+		}
+		if output != "text" && output != "json" {
+			return fmt.Errorf("invalid output format %q", output)
+		}
+		serviceName := args[0]
+		desiredVersion, _, err := serviceVersion(cmd, ecs, serviceName, clusterName)
+		if err != nil {
+			return err
+		}
+		diffs, err := serviceDiffs(ecs, clusterName, []aws.ServiceInfo{{ARN: serviceName, TaskARN: desiredVersion}})
+		if err != nil {
+			return err
+		}
+		if output == "json" {
+			encoder := json.NewEncoder(cmd.OutOrStdout())
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(diffs)
+		}
+		printDiffs(cmd.OutOrStdout(), diffs, isTerminal(cmd.OutOrStdout()))
+		return nil
+	}
+}
+
+// diffCmd represents the diff command.
+var diffCmd = &cobra.Command{
+	Use:   "diff [flags] <service-name>",
+	Short: "Show changes between current task definition and the one a rollback would use",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		// This hook helps to inject runtime parameters to the ecsProvider.
+		ecs, err := ecsClient(cmd)
+		if err != nil {
+			return err
+		}
+		cmd.RunE = makeDiffRunE(ecs)
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Overridden by PersistentPreRun.
+		return nil
+	},
+}
+
+func init() {
+	diffCmd.Flags().StringP("cluster", "c", "", "The ECS cluster name when the service run")
+	diffCmd.Flags().StringP("output", "o", "text", "Output format: text or json")
+	addVersionFlags(diffCmd)
+	rootCmd.AddCommand(diffCmd)
+}
@@ -0,0 +1,71 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/eraclitux/ecsundo/internal/mock"
+	"github.com/eraclitux/ecsundo/internal/platform/aws"
+	"github.com/spf13/cobra"
+)
+
+func TestDiffJSON(t *testing.T) {
+	clusterName := "my-cluster-under-test-e"
+	serviceName := "my-service-under-test"
+	ecsService := &mock.ECSService{}
+	var out bytes.Buffer
+	rootCmd.SetArgs([]string{"diff", "-c", clusterName, "-o", "json", "--task-definition", "app:1", serviceName})
+	rootCmd.SetOutput(&out)
+	defer rootCmd.SetOutput(nil)
+	diffCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeDiffRunE(ecsService)
+		return nil
+	}
+	err := rootCmd.Execute()
+	if err != nil {
+		t.Log("running Execute():", err)
+		t.FailNow()
+	}
+	var diffs []aws.TaskDiff
+	if err := json.Unmarshal(out.Bytes(), &diffs); err != nil {
+		t.Fatalf("invalid json output: %s\n%s", err, out.String())
+	}
+	if len(diffs) != 1 || diffs[0].ToTaskARN != "app:1" || len(diffs[0].Changes) != 1 {
+		t.Fatal("wrong diff:", diffs)
+	}
+}
+
+func Test_printDiffs(t *testing.T) {
+	var out bytes.Buffer
+	printDiffs(&out, []aws.TaskDiff{{
+		ServiceARN:  "arn:aws:ecs:us-east-1:123456789012:service/my-service",
+		FromTaskARN: "arn:aws:ecs:us-east-1:123456789012:task-definition/app:2",
+		ToTaskARN:   "arn:aws:ecs:us-east-1:123456789012:task-definition/app:1",
+		Changes:     []aws.DiffEntry{{Field: "memory", From: "512", To: "1024"}},
+	}}, false)
+	want := "my-service: app:2 -> app:1\n  memory\n    - 512\n    + 1024\n"
+	if out.String() != want {
+		t.Fatalf("got:\n%s\nexpected:\n%s", out.String(), want)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/eraclitux/ecsundo/internal/platform/aws"
+	"github.com/spf13/cobra"
+)
+
+func makeHistoryRunE(ecs ecsProvider) func(cmd *cobra.Command, args []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		clusterName, err := serviceClusterName(cmd)
+		if err != nil {
+			return err
+		}
+		if len(args) <= 0 {
+			return errors.New("service name is mandatory")
+		}
+		limit, err := cmd.Flags().GetInt("limit")
+		if err != nil {
+			return err
+		}
+		versions, err := ecs.ServiceHistory(args[0], clusterName, limit)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "\tREVISION\tSTATUS\tREGISTERED\tCPU\tMEMORY\tIMAGES")
+		for _, version := range versions {
+			current := ""
+			if version.Current {
+				current = "*"
+			}
+			registeredAt := "-"
+			if !version.RegisteredAt.IsZero() {
+				registeredAt = version.RegisteredAt.Local().Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(
+				w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				current,
+				aws.TaskName(version.ARN),
+				version.Status,
+				registeredAt,
+				valueOrDash(version.CPU),
+				valueOrDash(version.Memory),
+				strings.Join(version.Images, ", "),
+			)
+		}
+		return w.Flush()
+	}
+}
+
+// valueOrDash returns s or a dash if it is empty.
+func valueOrDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// historyCmd represents the history command.
+var historyCmd = &cobra.Command{
+	Use:   "history [flags] <service-name>",
+	Short: "List task definition revisions of a service",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		// This hook helps to inject runtime parameters to the ecsProvider.
+		ecs, err := ecsClient(cmd)
+		if err != nil {
+			return err
+		}
+		cmd.RunE = makeHistoryRunE(ecs)
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Overridden by PersistentPreRun.
+		return nil
+	},
+}
+
+func init() {
+	historyCmd.Flags().StringP("cluster", "c", "", "The ECS cluster name when the service run")
+	historyCmd.Flags().IntP("limit", "l", 20, "Maximum number of revisions to list, 0 lists all of them")
+	rootCmd.AddCommand(historyCmd)
+}
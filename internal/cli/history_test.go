@@ -0,0 +1,59 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cli
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/eraclitux/ecsundo/internal/mock"
+	"github.com/spf13/cobra"
+)
+
+func TestHistory(t *testing.T) {
+	clusterName := "my-cluster-under-test-d"
+	serviceName := "my-service-under-test"
+	ecsService := &mock.ECSService{}
+	var out bytes.Buffer
+	rootCmd.SetArgs([]string{"history", "-c", clusterName, serviceName})
+	rootCmd.SetOutput(&out)
+	defer rootCmd.SetOutput(nil)
+	historyCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeHistoryRunE(ecsService)
+		return nil
+	}
+	err := rootCmd.Execute()
+	if err != nil {
+		t.Log("running Execute():", err)
+		t.FailNow()
+	}
+	if ecsService.ClusterName != clusterName {
+		t.Fatal("wrong clusterName")
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("wrong output:\n%s", out.String())
+	}
+	if !strings.HasPrefix(lines[1], "*") || !strings.Contains(lines[1], "app:2") {
+		t.Fatalf("current revision not marked:\n%s", out.String())
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cli
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/eraclitux/ecsundo/internal/platform/aws"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+)
+
+const journalFile = ".ecsundo.journal"
+
+// journalEntry records a service change made by ecsundo.
+type journalEntry struct {
+	// Run identifies all changes made by a single invocation.
+	Run         string    `json:"run"`
+	Time        time.Time `json:"time"`
+	Cluster     string    `json:"cluster"`
+	Service     string    `json:"service"`
+	FromTaskARN string    `json:"from_task_arn"`
+	ToTaskARN   string    `json:"to_task_arn"`
+}
+
+// journalPath returns the path of the journal file, it can be set with the
+// journal configuration key.
+func journalPath() (string, error) {
+	if path := viper.GetString("journal"); path != "" {
+		return path, nil
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, journalFile), nil
+}
+
+// appendJournal records changes made on a cluster as a single run.
+func appendJournal(clusterName string, changes []aws.ServiceChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	path, err := journalPath()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	now := time.Now().UTC()
+	run := now.Format(time.RFC3339Nano)
+	encoder := json.NewEncoder(f)
+	for _, change := range changes {
+		err := encoder.Encode(journalEntry{
+			Run:         run,
+			Time:        now,
+			Cluster:     clusterName,
+			Service:     change.ARN,
+			FromTaskARN: change.FromTaskARN,
+			ToTaskARN:   change.CurrentTaskARN(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// journalChanges records changes in the journal. It returns err if not nil,
+// otherwise the error from writing the journal.
+func journalChanges(clusterName string, changes []aws.ServiceChange, err error) error {
+	if jErr := appendJournal(clusterName, changes); jErr != nil {
+		if err == nil {
+			return fmt.Errorf("unable to write journal: %s", jErr)
+		}
+		fmt.Fprintln(os.Stderr, "unable to write journal:", jErr)
+	}
+	return err
+}
+
+// readJournal returns all entries in the journal, oldest first.
+func readJournal() ([]journalEntry, error) {
+	path, err := journalPath()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries := make([]journalEntry, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// journalStateAt returns the task versions ecsundo left services of a cluster
+// on at a given time, for services it changed before it. It also returns
+// services the journal does not know about.
+func journalStateAt(entries []journalEntry, clusterName string, serviceARNs []string, at time.Time) ([]aws.ServiceInfo, []string) {
+	servicesInfo := make([]aws.ServiceInfo, 0, len(serviceARNs))
+	unknown := make([]string, 0)
+	for _, serviceARN := range serviceARNs {
+		taskARN := ""
+		for _, entry := range entries {
+			if entry.Cluster != clusterName || entry.Time.After(at) {
+				continue
+			}
+			if entry.Service == serviceARN || aws.ServiceName(entry.Service) == aws.ServiceName(serviceARN) {
+				taskARN = entry.ToTaskARN
+			}
+		}
+		if taskARN == "" {
+			unknown = append(unknown, serviceARN)
+			continue
+		}
+		servicesInfo = append(servicesInfo, aws.ServiceInfo{ARN: serviceARN, TaskARN: taskARN})
+	}
+	return servicesInfo, unknown
+}
+
+// lastRun returns entries of the most recent run on a cluster. If
+// serviceName is not empty only the last change of that service is returned.
+func lastRun(entries []journalEntry, clusterName, serviceName string) []journalEntry {
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry.Cluster != clusterName {
+			continue
+		}
+		if serviceName != "" {
+			if serviceName == entry.Service || serviceName == aws.ServiceName(entry.Service) {
+				return []journalEntry{entry}
+			}
+			continue
+		}
+		run := make([]journalEntry, 0)
+		for _, e := range entries[:i+1] {
+			if e.Run == entry.Run && e.Cluster == clusterName {
+				run = append(run, e)
+			}
+		}
+		return run
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/eraclitux/ecsundo/internal/lock"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// defaultLockTTL is the time after which a lock expires if not configured
+// with the lock.ttl key.
+const defaultLockTTL = 30 * time.Minute
+
+// clusterLocker returns the locker for the backend configured with the
+// lock.backend key: file (default), dynamodb or tag.
+func clusterLocker(ecs ecsProvider) (lock.Locker, error) {
+	backend := viper.GetString("lock.backend")
+	if backend != "" && backend != "file" {
+		return ecs.Locker(backend, viper.GetString("lock.table"))
+	}
+	dir := viper.GetString("lock.path")
+	if dir == "" {
+		home, err := homedir.Dir()
+		if err != nil {
+			return nil, err
+		}
+		dir = home
+	}
+	return lock.NewFileLocker(dir), nil
+}
+
+// lostLocks records why locks of clusters held by this process could not be
+// refreshed.
+var (
+	lostLocks   = make(map[string]error)
+	lostLocksMu sync.Mutex
+)
+
+// checkLock returns an error if the lock of a cluster could not be
+// refreshed: someone else may hold it and no service must be changed.
+func checkLock(clusterName string) error {
+	lostLocksMu.Lock()
+	defer lostLocksMu.Unlock()
+	if err := lostLocks[clusterName]; err != nil {
+		return fmt.Errorf("lock of %q lost, no more changes made: %s", clusterName, err)
+	}
+	return nil
+}
+
+// lockCluster locks a cluster for a command that changes it. The lock is
+// refreshed every third of its TTL while the command runs, if that fails
+// checkLock stops further changes. The returned function releases it.
+// Nothing is locked in dry run.
+func lockCluster(cmd *cobra.Command, ecs ecsProvider, clusterName string) (func(), error) {
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return func() {}, nil
+	}
+	locker, err := clusterLocker(ecs)
+	if err != nil {
+		return nil, err
+	}
+	ttl := viper.GetDuration("lock.ttl")
+	if ttl <= 0 {
+		ttl = defaultLockTTL
+	}
+	info := lock.NewInfo(cmd.CommandPath(), ttl)
+	if err := locker.Acquire(clusterName, info); err != nil {
+		return nil, err
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				refreshed := info
+				refreshed.ExpiresAt = now.UTC().Add(ttl)
+				if err := locker.Refresh(clusterName, refreshed); err != nil {
+					fmt.Fprintf(os.Stderr, "unable to refresh lock of %q, stopping changes: %s\n", clusterName, err)
+					lostLocksMu.Lock()
+					lostLocks[clusterName] = err
+					lostLocksMu.Unlock()
+					return
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+		lostLocksMu.Lock()
+		delete(lostLocks, clusterName)
+		lostLocksMu.Unlock()
+		if err := locker.Release(clusterName, info); err != nil {
+			fmt.Fprintf(os.Stderr, "unable to release lock of %q: %s\n", clusterName, err)
+		}
+	}, nil
+}
+
+// lockClusterName returns cluster name from arguments or configuration.
+func lockClusterName(args []string) (string, error) {
+	clusterName := viper.GetString("cluster")
+	if len(args) > 0 {
+		clusterName = args[0]
+	}
+	if clusterName == "" {
+		return "", errors.New("cluster name is mandatory")
+	}
+	return clusterName, nil
+}
+
+func makeLockStatusRunE(ecs ecsProvider) func(cmd *cobra.Command, args []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		clusterName, err := lockClusterName(args)
+		if err != nil {
+			return err
+		}
+		locker, err := clusterLocker(ecs)
+		if err != nil {
+			return err
+		}
+		info, err := locker.Status(clusterName)
+		if err != nil {
+			return err
+		}
+		if info == nil {
+			fmt.Fprintf(cmd.OutOrStdout(), "cluster %q is not locked\n", clusterName)
+			return nil
+		}
+		expires := info.ExpiresAt.Local().Format(time.RFC3339)
+		if info.Expired(time.Now()) {
+			expires += " (expired)"
+		}
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "cluster:\t%s\n", clusterName)
+		fmt.Fprintf(w, "holder:\t%s\n", info.Holder)
+		fmt.Fprintf(w, "command:\t%s\n", info.Command)
+		fmt.Fprintf(w, "acquired:\t%s\n", info.AcquiredAt.Local().Format(time.RFC3339))
+		fmt.Fprintf(w, "expires:\t%s\n", expires)
+		return w.Flush()
+	}
+}
+
+func makeLockBreakRunE(ecs ecsProvider) func(cmd *cobra.Command, args []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		clusterName, err := lockClusterName(args)
+		if err != nil {
+			return err
+		}
+		locker, err := clusterLocker(ecs)
+		if err != nil {
+			return err
+		}
+		return locker.Break(clusterName)
+	}
+}
+
+// lockCmd represents the lock command.
+var lockCmd = &cobra.Command{
+	Use:   "lock",
+	Short: "Inspect locks preventing concurrent changes to a cluster",
+}
+
+// lockStatusCmd represents the lock status subcommand.
+var lockStatusCmd = &cobra.Command{
+	Use:   "status [flags] <cluster-name>",
+	Short: "Show who holds the lock of a cluster",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		// This hook helps to inject runtime parameters to ecsProvider.
+		ecs, err := ecsClient(cmd)
+		if err != nil {
+			return err
+		}
+		cmd.RunE = makeLockStatusRunE(ecs)
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Overridden by PersistentPreRun.
+		return nil
+	},
+}
+
+// lockBreakCmd represents the lock break subcommand.
+var lockBreakCmd = &cobra.Command{
+	Use:   "break [flags] <cluster-name>",
+	Short: "Release the lock of a cluster whoever holds it",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		// This hook helps to inject runtime parameters to ecsProvider.
+		ecs, err := ecsClient(cmd)
+		if err != nil {
+			return err
+		}
+		cmd.RunE = makeLockBreakRunE(ecs)
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Overridden by PersistentPreRun.
+		return nil
+	},
+}
+
+func init() {
+	lockCmd.AddCommand(lockStatusCmd)
+	lockCmd.AddCommand(lockBreakCmd)
+	rootCmd.AddCommand(lockCmd)
+}
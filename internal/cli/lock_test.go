@@ -0,0 +1,146 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cli
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eraclitux/ecsundo/internal/lock"
+	"github.com/eraclitux/ecsundo/internal/mock"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func TestClusterRollbackLocked(t *testing.T) {
+	clusterName := "my-cluster-under-test-locked"
+	locker := lock.NewFileLocker(viper.GetString("lock.path"))
+	info := lock.NewInfo("ecsundo cluster", time.Hour)
+	info.Holder = "someone@elsewhere"
+	if err := locker.Acquire(clusterName, info); err != nil {
+		t.Fatal(err)
+	}
+	defer locker.Break(clusterName)
+	ecsService := &mock.ECSService{}
+	rootCmd.SetArgs([]string{"cluster", "--yes", clusterName})
+	defer clusterCmd.Flags().Set("yes", "false")
+	clusterCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeClusterRunE(ecsService)
+		return nil
+	}
+	err := rootCmd.Execute()
+	if err == nil || !strings.Contains(err.Error(), "someone@elsewhere") {
+		t.Fatal("lock not honoured:", err)
+	}
+	if ecsService.ClusterName != "" {
+		t.Fatal("cluster changed:", ecsService.ClusterName)
+	}
+
+	var buf bytes.Buffer
+	rootCmd.SetOutput(&buf)
+	defer rootCmd.SetOutput(nil)
+	rootCmd.SetArgs([]string{"lock", "status", clusterName})
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatal("running Execute():", err)
+	}
+	if !strings.Contains(buf.String(), "someone@elsewhere") {
+		t.Fatal("holder not shown:", buf.String())
+	}
+
+	rootCmd.SetArgs([]string{"lock", "break", clusterName})
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatal("running Execute():", err)
+	}
+	rootCmd.SetArgs([]string{"cluster", "--yes", clusterName})
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatal("running Execute():", err)
+	}
+	if ecsService.ClusterName != clusterName {
+		t.Fatal("wrong clusterName:", ecsService.ClusterName)
+	}
+	status, err := locker.Status(clusterName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != nil {
+		t.Fatal("lock not released:", status)
+	}
+}
+
+func Test_lockClusterRefresh(t *testing.T) {
+	clusterName := "my-cluster-under-test-refresh"
+	viper.Set("lock.ttl", 30*time.Millisecond)
+	defer viper.Set("lock.ttl", 0)
+	unlock, err := lockCluster(clusterCmd, &mock.ECSService{}, clusterName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	locker := lock.NewFileLocker(viper.GetString("lock.path"))
+	acquired, err := locker.Status(clusterName)
+	if err != nil || acquired == nil {
+		t.Fatal("lock not acquired:", acquired, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	refreshed, err := locker.Status(clusterName)
+	if err != nil || refreshed == nil || !refreshed.ExpiresAt.After(acquired.ExpiresAt) {
+		t.Fatal("lock not refreshed:", refreshed, err)
+	}
+	if refreshed.Expired(time.Now()) {
+		t.Fatal("lock expired while held:", refreshed)
+	}
+}
+
+func Test_lockClusterLost(t *testing.T) {
+	clusterName := "my-cluster-under-test-lost"
+	viper.Set("lock.ttl", 30*time.Millisecond)
+	defer viper.Set("lock.ttl", 0)
+	unlock, err := lockCluster(clusterCmd, &mock.ECSService{}, clusterName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkLock(clusterName); err != nil {
+		t.Fatal("lock reported lost:", err)
+	}
+	// Someone else takes the lock.
+	locker := lock.NewFileLocker(viper.GetString("lock.path"))
+	if err := locker.Break(clusterName); err != nil {
+		t.Fatal(err)
+	}
+	other := lock.NewInfo("ecsundo cluster", time.Hour)
+	if err := locker.Acquire(clusterName, other); err != nil {
+		t.Fatal(err)
+	}
+	defer locker.Break(clusterName)
+	time.Sleep(100 * time.Millisecond)
+	if err := checkLock(clusterName); err == nil {
+		t.Fatal("lost lock not reported")
+	}
+	unlock()
+	if err := checkLock(clusterName); err != nil {
+		t.Fatal("released lock reported lost:", err)
+	}
+	if status, _ := locker.Status(clusterName); status == nil || status.ID != other.ID {
+		t.Fatal("lock of someone else released:", status)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/eraclitux/ecsundo/internal/platform/aws"
+)
+
+// pickerLimit is the number of revisions listed for each service.
+const pickerLimit = 10
+
+// stdin is where interactive commands read user input from.
+var stdin io.Reader = os.Stdin
+
+// errAborted is returned when user does not confirm a change.
+var errAborted = errors.New("aborted by user")
+
+// pickClusterVersions lets user choose task versions for services of a
+// cluster selected by filter.
+func pickClusterVersions(ecs ecsProvider, clusterName string, filter aws.ServiceFilter, out io.Writer) ([]aws.ServiceInfo, error) {
+	servicesInfo, err := ecs.ClusterSnapshot(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	servicesInfo, err = ecs.FilterServices(servicesInfo, clusterName, filter)
+	if err != nil {
+		return nil, err
+	}
+	history := make(map[string][]aws.TaskVersion, len(servicesInfo))
+	for _, serviceInfo := range servicesInfo {
+		versions, err := ecs.ServiceHistory(serviceInfo.ARN, clusterName, pickerLimit)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %s", aws.ServiceName(serviceInfo.ARN), err)
+		}
+		history[serviceInfo.ARN] = versions
+	}
+	return pickVersions(stdin, out, history)
+}
+
+// pickVersions shows task versions of services and lets user choose which
+// ones to rollback to, at most one for each service. Chosen versions are
+// returned after confirmation.
+func pickVersions(in io.Reader, out io.Writer, history map[string][]aws.TaskVersion) ([]aws.ServiceInfo, error) {
+	services := make([]string, 0, len(history))
+	for service := range history {
+		services = append(services, service)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return aws.ServiceName(services[i]) < aws.ServiceName(services[j])
+	})
+	type choice struct {
+		service string
+		version aws.TaskVersion
+	}
+	choices := make([]choice, 0)
+	currents := make(map[string]string, len(services))
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, service := range services {
+		fmt.Fprintf(w, "%s\n", aws.ServiceName(service))
+		for _, version := range history[service] {
+			choices = append(choices, choice{service: service, version: version})
+			marker := ""
+			if version.Current {
+				marker = "(current)"
+				currents[service] = version.ARN
+			}
+			fmt.Fprintf(
+				w, "  %d)\t%s\t%s\t%s\t%s\t%s\n",
+				len(choices),
+				aws.TaskName(version.ARN),
+				version.Status,
+				version.RegisteredAt.Local().Format("2006-01-02 15:04"),
+				strings.Join(version.Images, ", "),
+				marker,
+			)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(in)
+	for {
+		fmt.Fprint(out, "Versions to rollback to (e.g. 2 5), empty to abort: ")
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if strings.TrimSpace(line) == "" {
+			return nil, errAborted
+		}
+		selection, selErr := parseSelection(line, len(choices))
+		if selErr == nil && len(selection) == 0 {
+			selErr = errors.New("no version chosen")
+		}
+		picked := make([]aws.ServiceInfo, 0, len(selection))
+		seen := make(map[string]bool, len(selection))
+		for _, n := range selection {
+			c := choices[n-1]
+			switch {
+			case seen[c.service]:
+				selErr = fmt.Errorf("more than one version chosen for %q", aws.ServiceName(c.service))
+			case c.version.Current:
+				selErr = fmt.Errorf("%q already runs %s", aws.ServiceName(c.service), aws.TaskName(c.version.ARN))
+			}
+			seen[c.service] = true
+			picked = append(picked, aws.ServiceInfo{ARN: c.service, TaskARN: c.version.ARN})
+		}
+		if selErr != nil {
+			fmt.Fprintln(out, selErr)
+			if err == io.EOF {
+				return nil, selErr
+			}
+			continue
+		}
+		fmt.Fprintln(out, "\nThese services will be changed:")
+		for _, p := range picked {
+			fmt.Fprintf(out, "  %s: %s -> %s\n", aws.ServiceName(p.ARN), aws.TaskName(currents[p.ARN]), aws.TaskName(p.TaskARN))
+		}
+		fmt.Fprint(out, "Proceed? [y/N]: ")
+		answer, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "y" && answer != "yes" {
+			return nil, errAborted
+		}
+		return picked, nil
+	}
+}
+
+// parseSelection parses a list of choice numbers, between 1 and max,
+// separated by spaces or commas.
+func parseSelection(input string, max int) ([]int, error) {
+	fields := strings.FieldsFunc(input, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	selection := make([]int, 0, len(fields))
+	for _, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 1 || n > max {
+			return nil, fmt.Errorf("invalid choice %q", field)
+		}
+		selection = append(selection, n)
+	}
+	return selection, nil
+}
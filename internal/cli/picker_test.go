@@ -0,0 +1,108 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/eraclitux/ecsundo/internal/mock"
+	"github.com/eraclitux/ecsundo/internal/platform/aws"
+	"github.com/spf13/cobra"
+)
+
+func Test_parseSelection(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []int
+		wantErr bool
+	}{
+		{input: "1", want: []int{1}},
+		{input: "2, 3 4\n", want: []int{2, 3, 4}},
+		{input: "0", wantErr: true},
+		{input: "5", wantErr: true},
+		{input: "a", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseSelection(tt.input, 4)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSelection(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseSelection(%q) = %v, want %v", tt.input, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("parseSelection(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestServiceRollbackInteractive(t *testing.T) {
+	clusterName := "my-cluster-under-test-a"
+	serviceName := "my-service-under-test"
+	ecsService := &mock.ECSService{}
+	// First choice is the current version and it is refused.
+	stdin = strings.NewReader("1\n2\ny\n")
+	defer func() { stdin = os.Stdin }()
+	rootCmd.SetArgs([]string{"service", "-c", clusterName, "-i", serviceName})
+	rootCmd.SetOutput(ioutil.Discard)
+	defer rootCmd.SetOutput(nil)
+	serviceCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeServiceRunE(ecsService)
+		return nil
+	}
+	defer serviceCmd.Flags().Set("interactive", "false")
+	err := rootCmd.Execute()
+	if err != nil {
+		t.Log("running Execute():", err)
+		t.FailNow()
+	}
+	if ecsService.Version != "arn:aws:ecs:us-east-1:123456789012:task-definition/app:1" {
+		t.Fatal("wrong version:", ecsService.Version)
+	}
+}
+
+func Test_pickVersionsEmptySelection(t *testing.T) {
+	const arn = "arn:aws:ecs:us-east-1:123456789012:task-definition/app:"
+	history := map[string][]aws.TaskVersion{
+		"service-a": {
+			{ARN: arn + "2", Status: "ACTIVE", Current: true},
+			{ARN: arn + "1", Status: "ACTIVE"},
+		},
+	}
+	// A selection without versions is asked again.
+	picked, err := pickVersions(strings.NewReader(",\n2\ny\n"), ioutil.Discard, history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(picked) != 1 || picked[0].TaskARN != arn+"1" {
+		t.Fatal("wrong versions picked:", picked)
+	}
+	if _, err := pickVersions(strings.NewReader(","), ioutil.Discard, history); err == nil {
+		t.Fatal("empty selection accepted")
+	}
+}
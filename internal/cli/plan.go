@@ -0,0 +1,63 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cli
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/eraclitux/ecsundo/internal/platform/aws"
+)
+
+// showPlan prints the changes rolling back services would make, without
+// making them.
+func showPlan(ecs ecsProvider, clusterName string, servicesInfo []aws.ServiceInfo, opts aws.RollbackOptions, out io.Writer) error {
+	plan, err := ecs.PlanRollback(servicesInfo, clusterName, opts)
+	if err != nil {
+		return fmt.Errorf("error for %q: %s", clusterName, err)
+	}
+	if err := printPlan(out, plan); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out, "dry run, no service changed")
+	return err
+}
+
+// printPlan prints a table of planned changes.
+func printPlan(out io.Writer, plan []aws.PlannedChange) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tCURRENT\tTARGET\tREGISTER")
+	for _, change := range plan {
+		register := "no"
+		if change.Register {
+			register = "yes"
+		}
+		fmt.Fprintf(
+			w, "%s\t%s\t%s\t%s\n",
+			aws.ServiceName(change.ARN),
+			aws.TaskName(change.FromTaskARN),
+			aws.TaskName(change.ToTaskARN),
+			register,
+		)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,178 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/eraclitux/ecsundo/internal/platform/aws"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// redo restores services changed by the last run recorded in the journal for
+// a cluster, or only the last change of a service if serviceName is not empty.
+// Services are restored one at a time, in reverse order of their changes.
+func redo(cmd *cobra.Command, ecs ecsProvider, clusterName, serviceName string) error {
+	entries, err := readJournal()
+	if err != nil {
+		return err
+	}
+	run := lastRun(entries, clusterName, serviceName)
+	if len(run) == 0 {
+		return fmt.Errorf("nothing to redo for %q", clusterName)
+	}
+	servicesInfo := make([]aws.ServiceInfo, 0, len(run))
+	serviceNames := make([]string, 0, len(run))
+	// Deployments of the changes being undone may still be in progress.
+	redoing := make(map[string]string, len(run))
+	// A service changed more than once, e.g. compensated by an atomic
+	// rollback, goes back to the version before its first change.
+	seen := make(map[string]int, len(run))
+	for i := len(run) - 1; i >= 0; i-- {
+		// Journaled services are names or ARNs, as they were given.
+		name := aws.ServiceName(run[i].Service)
+		if j, ok := seen[name]; ok {
+			servicesInfo[j].TaskARN = run[i].FromTaskARN
+			continue
+		}
+		seen[name] = len(servicesInfo)
+		servicesInfo = append(
+			servicesInfo,
+			aws.ServiceInfo{ARN: run[i].Service, TaskARN: run[i].FromTaskARN},
+		)
+		serviceNames = append(serviceNames, run[i].Service)
+		redoing[name] = run[i].ToTaskARN
+	}
+	timeout, err := healthTimeout(cmd)
+	if err != nil {
+		return err
+	}
+	opts := aws.RollbackOptions{HealthTimeout: timeout, Redoing: redoing, BatchSize: 1}
+	if err := deploymentOptions(cmd, ecs, clusterName, &opts); err != nil {
+		return err
+	}
+	if err := barrierOptions(cmd, &opts); err != nil {
+		return err
+	}
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		return showPlan(ecs, clusterName, servicesInfo, opts, cmd.OutOrStdout())
+	}
+	unlock, err := lockCluster(cmd, ecs, clusterName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := safetySnapshot(cmd, ecs, clusterName, servicesSelector(serviceNames)); err != nil {
+		return err
+	}
+	started := time.Now()
+	changes, err := ecs.ClusterRestore(servicesInfo, clusterName, opts)
+	auditChanges(ecs, clusterName, serviceName, started, changes, err)
+	err = journalChanges(clusterName, changes, err)
+	if err != nil {
+		return fmt.Errorf("error for %q: %s", clusterName, err)
+	}
+	return waitChanges(cmd, ecs, clusterName, changes)
+}
+
+func makeRedoClusterRunE(ecs ecsProvider) func(cmd *cobra.Command, args []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		clusterName := viper.GetString("cluster")
+		if len(args) > 0 {
+			clusterName = args[0]
+		}
+		if clusterName == "" {
+			return errors.New("cluster name is mandatory")
+		}
+		return redo(cmd, ecs, clusterName, "")
+	}
+}
+
+func makeRedoServiceRunE(ecs ecsProvider) func(cmd *cobra.Command, args []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		clusterName, err := serviceClusterName(cmd)
+		if err != nil {
+			return err
+		}
+		if len(args) <= 0 {
+			return errors.New("service name is mandatory")
+		}
+		return redo(cmd, ecs, clusterName, args[0])
+	}
+}
+
+// redoCmd represents the redo command.
+var redoCmd = &cobra.Command{
+	Use:   "redo",
+	Short: "Undo the last rollback recorded in the journal",
+}
+
+// redoClusterCmd represents the redo cluster subcommand.
+var redoClusterCmd = &cobra.Command{
+	Use:   "cluster [flags] <cluster-name>",
+	Short: "Restore all services changed by the last run on a cluster",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		// This hook helps to inject runtime parameters to ecsProvider.
+		ecs, err := ecsClient(cmd)
+		if err != nil {
+			return err
+		}
+		cmd.RunE = makeRedoClusterRunE(ecs)
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Overridden by PersistentPreRun.
+		return nil
+	},
+}
+
+// redoServiceCmd represents the redo service subcommand.
+var redoServiceCmd = &cobra.Command{
+	Use:   "service [flags] <service-name>",
+	Short: "Restore a service to the version before its last rollback",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		// This hook helps to inject runtime parameters to ecsProvider.
+		ecs, err := ecsClient(cmd)
+		if err != nil {
+			return err
+		}
+		cmd.RunE = makeRedoServiceRunE(ecs)
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Overridden by PersistentPreRun.
+		return nil
+	},
+}
+
+func init() {
+	redoServiceCmd.Flags().StringP("cluster", "c", "", "The ECS cluster name when the service run")
+	redoCmd.AddCommand(redoClusterCmd)
+	redoCmd.AddCommand(redoServiceCmd)
+	rootCmd.AddCommand(redoCmd)
+}
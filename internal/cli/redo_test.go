@@ -0,0 +1,158 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/eraclitux/ecsundo/internal/mock"
+	"github.com/eraclitux/ecsundo/internal/platform/aws"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func TestMain(m *testing.M) {
+	// Keep files written by tests away from $HOME.
+	dir, err := ioutil.TempDir("", "ecsundo")
+	if err != nil {
+		panic(err)
+	}
+	viper.Set("journal", filepath.Join(dir, "journal"))
+	viper.Set("lock.path", dir)
+	viper.Set("snapshots.path", filepath.Join(dir, "snapshots"))
+	viper.Set("audit.path", filepath.Join(dir, "audit"))
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestRedoCluster(t *testing.T) {
+	clusterName := "my-cluster-under-test-c"
+	err := appendJournal(clusterName, []aws.ServiceChange{
+		{ARN: "service-a", FromTaskARN: "task-a:1", ToTaskARN: "task-a:2"},
+		{ARN: "service-b", FromTaskARN: "task-b:4", ToTaskARN: "task-b:3", RegisteredTaskARN: "task-b:5"},
+	})
+	if err != nil {
+		t.Fatal("writing journal:", err)
+	}
+	ecsService := &mock.ECSService{}
+	rootCmd.SetArgs([]string{"redo", "cluster", clusterName})
+	redoClusterCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeRedoClusterRunE(ecsService)
+		return nil
+	}
+	err = rootCmd.Execute()
+	if err != nil {
+		t.Log("running Execute():", err)
+		t.FailNow()
+	}
+	want := []aws.ServiceInfo{
+		{ARN: "service-b", TaskARN: "task-b:4"},
+		{ARN: "service-a", TaskARN: "task-a:1"},
+	}
+	if len(ecsService.Restored) != len(want) {
+		t.Fatal("wrong number of restored services:", len(ecsService.Restored))
+	}
+	for i := range want {
+		if ecsService.Restored[i] != want[i] {
+			t.Fatalf("restored[%d] = %v, want %v", i, ecsService.Restored[i], want[i])
+		}
+	}
+	if ecsService.Options.BatchSize != 1 {
+		t.Fatal("services not restored one at a time:", ecsService.Options.BatchSize)
+	}
+	entries, err := readJournal()
+	if err != nil {
+		t.Fatal("reading journal:", err)
+	}
+	for _, serviceInfo := range want {
+		last := lastRun(entries, clusterName, serviceInfo.ARN)
+		if len(last) != 1 || last[0].ToTaskARN != serviceInfo.TaskARN {
+			t.Fatal("redo not recorded in journal:", last)
+		}
+	}
+}
+
+func TestRedoInProgress(t *testing.T) {
+	clusterName := "my-cluster-under-test-e"
+	err := appendJournal(clusterName, []aws.ServiceChange{
+		{ARN: "service-a", FromTaskARN: "task-a:2", ToTaskARN: "task-a:1"},
+	})
+	if err != nil {
+		t.Fatal("writing journal:", err)
+	}
+	// The rollback being undone is still rolling out.
+	ecsService := &mock.ECSService{InProgress: []string{"service-a"}}
+	rootCmd.SetArgs([]string{"redo", "cluster", clusterName})
+	redoClusterCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeRedoClusterRunE(ecsService)
+		return nil
+	}
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatal("running Execute():", err)
+	}
+	if len(ecsService.Restored) != 1 || ecsService.Restored[0].TaskARN != "task-a:2" {
+		t.Fatal("wrong restored services:", ecsService.Restored)
+	}
+}
+
+func TestRedoCompensated(t *testing.T) {
+	clusterName := "my-cluster-under-test-f"
+	err := appendJournal(clusterName, []aws.ServiceChange{
+		{ARN: "service-a", FromTaskARN: "task-a:2", ToTaskARN: "task-a:1"},
+		{ARN: "service-b", FromTaskARN: "task-b:4", ToTaskARN: "task-b:3"},
+		{ARN: "service-a", FromTaskARN: "task-a:1", ToTaskARN: "task-a:2", Compensation: true},
+	})
+	if err != nil {
+		t.Fatal("writing journal:", err)
+	}
+	ecsService := &mock.ECSService{}
+	rootCmd.SetArgs([]string{"redo", "cluster", clusterName})
+	redoClusterCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeRedoClusterRunE(ecsService)
+		return nil
+	}
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatal("running Execute():", err)
+	}
+	restored := make(map[string]string)
+	for _, serviceInfo := range ecsService.Restored {
+		restored[serviceInfo.ARN] = serviceInfo.TaskARN
+	}
+	if len(ecsService.Restored) != 2 || restored["service-a"] != "task-a:2" || restored["service-b"] != "task-b:4" {
+		t.Fatal("wrong restored services:", ecsService.Restored)
+	}
+}
+
+func TestRedoNothing(t *testing.T) {
+	ecsService := &mock.ECSService{}
+	rootCmd.SetArgs([]string{"redo", "service", "-c", "my-cluster-without-journal", "my-service"})
+	redoServiceCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeRedoServiceRunE(ecsService)
+		return nil
+	}
+	if err := rootCmd.Execute(); err == nil {
+		t.Fatal("expected error with empty journal")
+	}
+}
@@ -21,9 +21,12 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"time"
 
+	"github.com/eraclitux/ecsundo/internal/platform/aws"
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -45,6 +48,22 @@ var completionCmd = &cobra.Command{
 	},
 }
 
+// ecsClient returns an ecsProvider configured from command flags.
+func ecsClient(cmd *cobra.Command) (*aws.ECSService, error) {
+	verbose, err := cmd.Flags().GetBool("verbose")
+	if err != nil {
+		return nil, err
+	}
+	concurrency, err := cmd.Flags().GetInt("concurrency")
+	if err != nil {
+		return nil, err
+	}
+	if concurrency < 1 {
+		return nil, errors.New("concurrency must be a positive number")
+	}
+	return aws.NewECSClient(verbose, concurrency), nil
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -58,6 +77,15 @@ func init() {
 	cobra.OnInitialize(initConfig)
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.ecsundo.yaml)")
 	rootCmd.PersistentFlags().BoolP("verbose", "v", false, "Verbose output")
+	rootCmd.PersistentFlags().Int("concurrency", aws.DefaultConcurrency, "Maximum number of services worked on at the same time")
+	rootCmd.PersistentFlags().Bool("dry-run", false, "Print changes that would be made without making them")
+	rootCmd.PersistentFlags().Bool("wait", false, "Wait until changed services are stable")
+	rootCmd.PersistentFlags().Bool("check-targets", false, "Wait until load balancer targets of changed services are healthy")
+	rootCmd.PersistentFlags().Bool("force", false, "Change services even if they have a deployment in progress")
+	rootCmd.PersistentFlags().Bool("wait-deployments", false, "Wait for deployments in progress to settle before changing services")
+	rootCmd.PersistentFlags().Bool("allow-barrier", false, "Rollback services past revisions marked as barriers")
+	rootCmd.PersistentFlags().Bool("no-snapshot", false, "Do not save a snapshot of services before changing them")
+	rootCmd.PersistentFlags().Duration("timeout", 10*time.Minute, "Maximum time to wait for services to be stable or healthy")
 	rootCmd.AddCommand(completionCmd)
 }
 
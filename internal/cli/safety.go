@@ -0,0 +1,155 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eraclitux/ecsundo/internal/platform/aws"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	snapshotsDir = ".ecsundo-snapshots"
+	// snapshotTimeFormat timestamps pre-change snapshots, it sorts as time.
+	snapshotTimeFormat = "20060102T150405Z"
+	// defaultSnapshotsKept is the number of pre-change snapshots kept for
+	// every cluster if not configured with the snapshots.keep key.
+	defaultSnapshotsKept = 10
+)
+
+// snapshotsPath returns the directory of pre-change snapshots, it can be
+// set with the snapshots.path configuration key.
+func snapshotsPath() (string, error) {
+	if path := viper.GetString("snapshots.path"); path != "" {
+		return path, nil
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, snapshotsDir), nil
+}
+
+// safetySnapshot saves the versions services selected by filter are running
+// before a command changes them, and prints how to restore them. Nothing is
+// saved with --no-snapshot or in dry run, a warning is printed if filter
+// selects no service.
+func safetySnapshot(cmd *cobra.Command, ecs ecsProvider, clusterName string, filter aws.ServiceFilter) error {
+	for _, name := range []string{"no-snapshot", "dry-run"} {
+		skip, err := cmd.Flags().GetBool(name)
+		if err != nil {
+			return err
+		}
+		if skip {
+			return nil
+		}
+	}
+	servicesInfo, err := ecs.ClusterSnapshot(clusterName)
+	if err == nil {
+		servicesInfo, err = ecs.FilterServices(servicesInfo, clusterName, filter)
+	}
+	if err != nil {
+		return fmt.Errorf("error for %q, unable to take pre-change snapshot: %s", clusterName, err)
+	}
+	if len(servicesInfo) == 0 {
+		fmt.Fprintf(cmd.OutOrStderr(), "warning: no service of %q selected, pre-change snapshot not saved\n", clusterName)
+		return nil
+	}
+	dir, err := snapshotsPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	name := clusterName + "-" + time.Now().UTC().Format(snapshotTimeFormat) + fileSuffix
+	filePath := filepath.Join(dir, name)
+	if err := writeSnapshot(filePath, servicesInfo); err != nil {
+		return err
+	}
+	keep := defaultSnapshotsKept
+	if viper.IsSet("snapshots.keep") {
+		keep = viper.GetInt("snapshots.keep")
+	}
+	if err := pruneSnapshots(dir, clusterName, keep); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to remove old snapshots of %q: %s\n", clusterName, err)
+	}
+	fmt.Fprintf(
+		cmd.OutOrStdout(),
+		"pre-change snapshot of %d services saved, to restore it run:\n  ecsundo cluster restore -s %s %s\n",
+		len(servicesInfo), filePath, clusterName,
+	)
+	return nil
+}
+
+// pruneSnapshots removes the oldest pre-change snapshots of a cluster
+// keeping the most recent ones. All are kept if keep is not positive.
+func pruneSnapshots(dir, clusterName string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	prefix := clusterName + "-"
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+		// Clusters whose name starts with this one share the prefix.
+		ts := strings.TrimSuffix(strings.TrimPrefix(name, prefix), fileSuffix)
+		if _, err := time.Parse(snapshotTimeFormat, ts); err != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	if len(names) <= keep {
+		return nil
+	}
+	sort.Strings(names)
+	for _, name := range names[:len(names)-keep] {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// servicesSelector returns a filter selecting services by name.
+func servicesSelector(serviceNames []string) aws.ServiceFilter {
+	include := make([]string, 0, len(serviceNames))
+	for _, name := range serviceNames {
+		include = append(include, aws.ServiceName(name))
+	}
+	return aws.ServiceFilter{Include: include}
+}
@@ -0,0 +1,176 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cli
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/eraclitux/ecsundo/internal/mock"
+	"github.com/eraclitux/ecsundo/internal/platform/aws"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func TestClusterRollbackSafetySnapshot(t *testing.T) {
+	clusterName := "my-cluster-under-test-snapshot"
+	snapshot := []aws.ServiceInfo{
+		{ARN: "service-a", TaskARN: "task-a:2"},
+		{ARN: "service-b", TaskARN: "task-b:5"},
+	}
+	ecsService := &mock.ECSService{Snapshot: snapshot}
+	var buf bytes.Buffer
+	rootCmd.SetOutput(&buf)
+	defer rootCmd.SetOutput(nil)
+	rootCmd.SetArgs([]string{"cluster", "--yes", clusterName})
+	defer clusterCmd.Flags().Set("yes", "false")
+	clusterCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeClusterRunE(ecsService)
+		return nil
+	}
+	err := rootCmd.Execute()
+	if err != nil {
+		t.Fatal("running Execute():", err)
+	}
+	dir := viper.GetString("snapshots.path")
+	files, err := filepath.Glob(filepath.Join(dir, clusterName+"-*"+fileSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatal("wrong snapshots:", files)
+	}
+	if !strings.Contains(buf.String(), "ecsundo cluster restore -s "+files[0]+" "+clusterName) {
+		t.Fatal("restore command not shown:", buf.String())
+	}
+	servicesInfo, err := readSnapshot(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(servicesInfo, snapshot) {
+		t.Fatal("wrong snapshot:", servicesInfo)
+	}
+}
+
+func Test_pruneSnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ecsundo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	names := []string{
+		"prod-20261015T090000Z.ecsundo",
+		"prod-20261016T090000Z.ecsundo",
+		"prod-20261017T090000Z.ecsundo",
+		"prod-eu-20261001T090000Z.ecsundo",
+		"prod-notes.ecsundo",
+	}
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pruneSnapshots(dir, "prod", 2); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	left := make([]string, 0, len(files))
+	for _, f := range files {
+		left = append(left, f.Name())
+	}
+	want := []string{
+		"prod-20261016T090000Z.ecsundo",
+		"prod-20261017T090000Z.ecsundo",
+		"prod-eu-20261001T090000Z.ecsundo",
+		"prod-notes.ecsundo",
+	}
+	if !reflect.DeepEqual(left, want) {
+		t.Fatal("wrong snapshots left:", left)
+	}
+}
+
+func TestServiceRollbackSafetySnapshot(t *testing.T) {
+	clusterName := "my-cluster-under-test-service-snapshot"
+	web := aws.ServiceInfo{ARN: "arn:aws:ecs:us-east-1:123456789012:service/" + clusterName + "/web", TaskARN: "web:4"}
+	ecsService := &mock.ECSService{Snapshot: []aws.ServiceInfo{
+		web,
+		{ARN: "arn:aws:ecs:us-east-1:123456789012:service/" + clusterName + "/api", TaskARN: "api:7"},
+	}}
+	var buf bytes.Buffer
+	rootCmd.SetOutput(&buf)
+	defer rootCmd.SetOutput(nil)
+	rootCmd.SetArgs([]string{"service", "-c", clusterName, "web"})
+	serviceCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeServiceRunE(ecsService)
+		return nil
+	}
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatal("running Execute():", err)
+	}
+	files, err := filepath.Glob(filepath.Join(viper.GetString("snapshots.path"), clusterName+"-*"+fileSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatal("wrong snapshots:", files, buf.String())
+	}
+	servicesInfo, err := readSnapshot(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(servicesInfo, []aws.ServiceInfo{web}) {
+		t.Fatal("wrong snapshot:", servicesInfo)
+	}
+}
+
+func TestServiceRollbackNoSnapshotWarning(t *testing.T) {
+	clusterName := "my-cluster-under-test-service-no-snapshot"
+	ecsService := &mock.ECSService{}
+	var buf bytes.Buffer
+	rootCmd.SetOutput(&buf)
+	defer rootCmd.SetOutput(nil)
+	rootCmd.SetArgs([]string{"service", "-c", clusterName, "web"})
+	serviceCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeServiceRunE(ecsService)
+		return nil
+	}
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatal("running Execute():", err)
+	}
+	if !strings.Contains(buf.String(), "pre-change snapshot not saved") {
+		t.Fatal("missing snapshot warning:", buf.String())
+	}
+}
+
+func Test_servicesSelector(t *testing.T) {
+	filter := servicesSelector([]string{"web", "arn:aws:ecs:us-east-1:123456789012:service/prod/api"})
+	if want := []string{"web", "api"}; !reflect.DeepEqual(filter.Include, want) {
+		t.Errorf("servicesSelector() includes = %v, want %v", filter.Include, want)
+	}
+}
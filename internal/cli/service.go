@@ -21,42 +21,383 @@
 package cli
 
 import (
+	"bufio"
 	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/eraclitux/ecsundo/internal/platform/aws"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
+// serviceClusterName returns cluster name from the cluster flag of a
+// command or, if empty, from configuration.
+func serviceClusterName(cmd *cobra.Command) (string, error) {
+	clusterName, err := cmd.Flags().GetString("cluster")
+	if err != nil {
+		return "", err
+	}
+	if clusterName == "" {
+		clusterName = viper.GetString("cluster")
+	}
+	if clusterName == "" {
+		return "", errors.New("cluster cannot be empty")
+	}
+	return clusterName, nil
+}
+
+// addVersionFlags adds to a command flags used to choose the task version a
+// service is rolled back to.
+func addVersionFlags(cmd *cobra.Command) {
+	cmd.Flags().IntP("revision", "r", 0, "Rollback to this revision of the service task family")
+	cmd.Flags().StringP("task-definition", "t", "", "Rollback to this task definition (ARN or family:revision)")
+	cmd.Flags().BoolP("interactive", "i", false, "Choose the version to rollback to from a list")
+	cmd.Flags().Int("steps", 1, "Number of deployed versions to go back")
+	cmd.Flags().String("image-tag", "", "Rollback to the most recent version running an image with this tag, digest or substring")
+}
+
+// serviceVersion returns the task version to rollback a service to, as
+// chosen by flags added with addVersionFlags, and how the previous version
+// has been found if none is chosen.
+func serviceVersion(cmd *cobra.Command, ecs ecsProvider, serviceName, clusterName string) (string, string, error) {
+	revision, err := cmd.Flags().GetInt("revision")
+	if err != nil {
+		return "", "", err
+	}
+	taskDefinition, err := cmd.Flags().GetString("task-definition")
+	if err != nil {
+		return "", "", err
+	}
+	imageRef, err := cmd.Flags().GetString("image-tag")
+	if err != nil {
+		return "", "", err
+	}
+	steps, err := cmd.Flags().GetInt("steps")
+	if err != nil {
+		return "", "", err
+	}
+	if steps < 1 {
+		return "", "", errors.New("steps must be a positive number")
+	}
+	if steps > 1 && (taskDefinition != "" || revision != 0 || imageRef != "") {
+		return "", "", errors.New("--steps cannot be used with --revision, --task-definition or --image-tag")
+	}
+	if revision < 0 {
+		return "", "", errors.New("revision must be a positive number")
+	}
+	if revision > 0 {
+		if taskDefinition != "" {
+			return "", "", errors.New("--revision and --task-definition cannot be used together")
+		}
+		taskDefinition = strconv.Itoa(revision)
+	}
+	if imageRef != "" && taskDefinition != "" {
+		return "", "", errors.New("--image-tag cannot be used with --revision or --task-definition")
+	}
+	interactive, err := cmd.Flags().GetBool("interactive")
+	if err != nil {
+		return "", "", err
+	}
+	if interactive && (taskDefinition != "" || imageRef != "" || steps > 1) {
+		return "", "", errors.New("--interactive cannot be used with other version selectors")
+	}
+	switch {
+	case interactive:
+		versions, err := ecs.ServiceHistory(serviceName, clusterName, pickerLimit)
+		if err != nil {
+			return "", "", err
+		}
+		picked, err := pickVersions(stdin, cmd.OutOrStdout(), map[string][]aws.TaskVersion{serviceName: versions})
+		if err != nil {
+			return "", "", err
+		}
+		if len(picked) == 0 {
+			return "", "", errAborted
+		}
+		return picked[0].TaskARN, "", nil
+	case taskDefinition != "":
+		taskARN, err := ecs.ServiceVersion(serviceName, clusterName, taskDefinition)
+		return taskARN, "", err
+	case imageRef != "":
+		taskARN, err := ecs.ServiceImageVersion(serviceName, clusterName, imageRef)
+		return taskARN, "", err
+	default:
+		return ecs.ServicePreviousVersion(serviceName, clusterName, steps)
+	}
+}
+
+// readServiceNames reads service names from a file, one per line. Empty
+// lines and lines starting with # are skipped.
+func readServiceNames(filePath string) ([]string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var names []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names = append(names, line)
+	}
+	return names, scanner.Err()
+}
+
+// serviceNames returns service names from arguments and from the file given
+// with --services-file, without duplicates.
+func serviceNames(cmd *cobra.Command, args []string) ([]string, error) {
+	filePath, err := cmd.Flags().GetString("services-file")
+	if err != nil {
+		return nil, err
+	}
+	names := args
+	if filePath != "" {
+		fileNames, err := readServiceNames(filePath)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, fileNames...)
+	}
+	seen := make(map[string]bool, len(names))
+	unique := make([]string, 0, len(names))
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			unique = append(unique, name)
+		}
+	}
+	return unique, nil
+}
+
+// printChange prints the versions a service has been changed from and to
+// and, if known, how the version has been found.
+func printChange(w io.Writer, change aws.ServiceChange) {
+	line := fmt.Sprintf("%s: %s -> %s", aws.ServiceName(change.ARN), aws.TaskName(change.FromTaskARN), aws.TaskName(change.CurrentTaskARN()))
+	if change.Strategy != "" {
+		line += " (" + change.Strategy + ")"
+	}
+	fmt.Fprintln(w, line)
+}
+
+// rollbackServices rollbacks several services at once to their previous
+// versions, or to the versions running the image given with --image-tag,
+// reporting the result for every service.
+func rollbackServices(cmd *cobra.Command, ecs ecsProvider, clusterName string, serviceNames []string) error {
+	for _, name := range []string{"revision", "task-definition", "interactive", "container", "container-env", "show-diff"} {
+		if value := cmd.Flags().Lookup(name).Value.String(); value != "" && value != "0" && value != "false" {
+			return fmt.Errorf("--%s can be used only with a single service", name)
+		}
+	}
+	steps, err := cmd.Flags().GetInt("steps")
+	if err != nil {
+		return err
+	}
+	if steps < 1 {
+		return errors.New("steps must be a positive number")
+	}
+	imageRef, err := cmd.Flags().GetString("image-tag")
+	if err != nil {
+		return err
+	}
+	if imageRef != "" && steps > 1 {
+		return errors.New("--steps cannot be used with --image-tag")
+	}
+	timeout, err := healthTimeout(cmd)
+	if err != nil {
+		return err
+	}
+	opts := aws.RollbackOptions{Steps: steps, HealthTimeout: timeout}
+	if err := deploymentOptions(cmd, ecs, clusterName, &opts); err != nil {
+		return err
+	}
+	if err := barrierOptions(cmd, &opts); err != nil {
+		return err
+	}
+	if imageRef != "" {
+		opts.Images = make(map[string]string, len(serviceNames))
+		for _, name := range serviceNames {
+			opts.Images[name] = imageRef
+		}
+	}
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		servicesInfo := make([]aws.ServiceInfo, 0, len(serviceNames))
+		for _, name := range serviceNames {
+			servicesInfo = append(servicesInfo, aws.ServiceInfo{ARN: name, Image: opts.Images[name]})
+		}
+		return showPlan(ecs, clusterName, servicesInfo, opts, cmd.OutOrStdout())
+	}
+	if err := safetySnapshot(cmd, ecs, clusterName, servicesSelector(serviceNames)); err != nil {
+		return err
+	}
+	started := time.Now()
+	changes, err := ecs.ServicesRollback(serviceNames, clusterName, opts)
+	auditChanges(ecs, clusterName, "", started, changes, err)
+	for _, change := range changes {
+		printChange(cmd.OutOrStdout(), change)
+	}
+	err = journalChanges(clusterName, changes, err)
+	if err != nil {
+		return fmt.Errorf("error for %q: %s", clusterName, err)
+	}
+	return waitChanges(cmd, ecs, clusterName, changes)
+}
+
 func makeServiceRunE(ecs ecsProvider) func(cmd *cobra.Command, args []string) error {
 	return func(cmd *cobra.Command, args []string) error {
 		clusterName := viper.GetString("cluster")
 		if clusterName == "" {
 			return errors.New("cluster cannot be empty")
 		}
-		if len(args) <= 0 {
+		names, err := serviceNames(cmd, args)
+		if err != nil {
+			return err
+		}
+		if len(names) <= 0 {
 			return errors.New("service name is mandatory")
 		}
-		serviceName := args[0]
-		desiredVersion, err := ecs.ServicePreviousVersion(serviceName, clusterName)
+		unlock, err := lockCluster(cmd, ecs, clusterName)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		if len(names) > 1 {
+			return rollbackServices(cmd, ecs, clusterName, names)
+		}
+		serviceName := names[0]
+		containerName, err := cmd.Flags().GetString("container")
+		if err != nil {
+			return err
+		}
+		withEnv, err := cmd.Flags().GetBool("container-env")
+		if err != nil {
+			return err
+		}
+		if withEnv && containerName == "" {
+			return errors.New("--container-env requires --container")
+		}
+		showDiff, err := cmd.Flags().GetBool("show-diff")
+		if err != nil {
+			return err
+		}
+		if showDiff && containerName != "" {
+			return errors.New("--show-diff cannot be used with --container")
+		}
+		dryRun, err := cmd.Flags().GetBool("dry-run")
 		if err != nil {
 			return err
 		}
-		return ecs.ServiceRollback(serviceName, clusterName, desiredVersion)
+		var opts aws.RollbackOptions
+		if err := deploymentOptions(cmd, ecs, clusterName, &opts); err != nil {
+			return err
+		}
+		if err := barrierOptions(cmd, &opts); err != nil {
+			return err
+		}
+		if !dryRun {
+			// Check before versions are looked up, they depend on the
+			// deployment the service runs.
+			if err := ecs.CheckDeployments([]string{serviceName}, clusterName, opts); err != nil {
+				return err
+			}
+		}
+		desiredVersion, strategy, err := serviceVersion(cmd, ecs, serviceName, clusterName)
+		if err != nil {
+			return err
+		}
+		if !dryRun {
+			servicesInfo := []aws.ServiceInfo{{ARN: serviceName, TaskARN: desiredVersion}}
+			if err := ecs.CheckBarriers(servicesInfo, clusterName, opts); err != nil {
+				return err
+			}
+		}
+		if showDiff {
+			servicesInfo := []aws.ServiceInfo{{ARN: serviceName, TaskARN: desiredVersion}}
+			if err := showDiffs(ecs, clusterName, servicesInfo, cmd.OutOrStdout()); err != nil {
+				return err
+			}
+		}
+		if dryRun {
+			servicesInfo := []aws.ServiceInfo{{ARN: serviceName, TaskARN: desiredVersion}}
+			plan, err := ecs.PlanRollback(servicesInfo, clusterName, opts)
+			if err != nil {
+				return err
+			}
+			if containerName != "" {
+				// A container rollback always registers a new task definition.
+				plan[0].Register = true
+			}
+			if err := printPlan(cmd.OutOrStdout(), plan); err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), "dry run, no service changed")
+			return nil
+		}
+		err = safetySnapshot(cmd, ecs, clusterName, servicesSelector([]string{serviceName}))
+		if err != nil {
+			return err
+		}
+		if err := checkLock(clusterName); err != nil {
+			return err
+		}
+		started := time.Now()
+		var change aws.ServiceChange
+		if containerName != "" {
+			change, err = ecs.ServiceContainerRollback(serviceName, clusterName, desiredVersion, containerName, withEnv)
+		} else {
+			change, err = ecs.ServiceRollback(serviceName, clusterName, desiredVersion)
+		}
+		change.Duration = time.Since(started)
+		change.Strategy = strategy
+		if err != nil {
+			failure := aws.ServiceFailure{ServiceChange: change, Err: err}
+			failure.ARN, failure.ToTaskARN = serviceName, desiredVersion
+			failures := []aws.ServiceFailure{failure}
+			auditChanges(ecs, clusterName, serviceName, started, nil, &aws.RollbackError{Failures: failures, Err: err})
+			return err
+		}
+		changes := []aws.ServiceChange{change}
+		auditChanges(ecs, clusterName, "", started, changes, nil)
+		printChange(cmd.OutOrStdout(), change)
+		if err := journalChanges(clusterName, changes, nil); err != nil {
+			return err
+		}
+		timeout, err := healthTimeout(cmd)
+		if err != nil {
+			return err
+		}
+		if timeout > 0 {
+			err = ecs.WaitTargetsHealthy(serviceName, clusterName, change.CurrentTaskARN(), timeout)
+			if err != nil {
+				return err
+			}
+		}
+		return waitChanges(cmd, ecs, clusterName, changes)
 	}
 }
 
 // serviceCmd represents the service command.
 var serviceCmd = &cobra.Command{
-	Use:   "service [flags] <service-name>",
-	Short: "Rollback an ECS service by name",
+	Use:   "service [flags] <service-name>...",
+	Short: "Rollback ECS services by name",
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 		// This hook helps to inject runtime parameters to the ecsProvider.
-		verbose, err := cmd.Flags().GetBool("verbose")
+		ecs, err := ecsClient(cmd)
 		if err != nil {
 			return err
 		}
-		cmd.RunE = makeServiceRunE(aws.NewECSClient(verbose))
+		cmd.RunE = makeServiceRunE(ecs)
 		return nil
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
@@ -68,5 +409,10 @@ var serviceCmd = &cobra.Command{
 func init() {
 	serviceCmd.PersistentFlags().StringP("cluster", "c", "", "The ECS cluster name when the service run")
 	viper.BindPFlag("cluster", serviceCmd.PersistentFlags().Lookup("cluster"))
+	addVersionFlags(serviceCmd)
+	serviceCmd.Flags().String("container", "", "Rollback only the image of this container, other containers keep their current configuration")
+	serviceCmd.Flags().Bool("container-env", false, "With --container, rollback also the container environment")
+	serviceCmd.Flags().Bool("show-diff", false, "Show changes between current and target task definitions")
+	serviceCmd.Flags().String("services-file", "", "Rollback also services listed in this file, one per line")
 	rootCmd.AddCommand(serviceCmd)
 }
@@ -21,9 +21,15 @@
 package cli
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/eraclitux/ecsundo/internal/mock"
+	"github.com/eraclitux/ecsundo/internal/platform/aws"
 	"github.com/spf13/cobra"
 )
 
@@ -48,3 +54,210 @@ func TestServiceRollback(t *testing.T) {
 		t.Fatal("wrong serviceName")
 	}
 }
+
+func TestServiceRollbackToRevision(t *testing.T) {
+	clusterName := "my-cluster-under-test-a"
+	serviceName := "my-service-under-test"
+	ecsService := &mock.ECSService{}
+	rootCmd.SetArgs([]string{"service", "-c", clusterName, "--revision", "3", serviceName})
+	serviceCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeServiceRunE(ecsService)
+		return nil
+	}
+	defer serviceCmd.Flags().Set("revision", "0")
+	err := rootCmd.Execute()
+	if err != nil {
+		t.Log("running Execute():", err)
+		t.FailNow()
+	}
+	if ecsService.ServiceName != serviceName {
+		t.Fatal("wrong serviceName")
+	}
+	if ecsService.Version != "3" {
+		t.Fatal("wrong version:", ecsService.Version)
+	}
+}
+
+func TestServiceRollbackSteps(t *testing.T) {
+	clusterName := "my-cluster-under-test-a"
+	serviceName := "my-service-under-test"
+	ecsService := &mock.ECSService{}
+	rootCmd.SetArgs([]string{"service", "-c", clusterName, "--steps", "3", serviceName})
+	serviceCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeServiceRunE(ecsService)
+		return nil
+	}
+	defer serviceCmd.Flags().Set("steps", "1")
+	err := rootCmd.Execute()
+	if err != nil {
+		t.Log("running Execute():", err)
+		t.FailNow()
+	}
+	if ecsService.Steps != 3 {
+		t.Fatal("wrong steps:", ecsService.Steps)
+	}
+}
+
+func TestServiceRollbackContainer(t *testing.T) {
+	clusterName := "my-cluster-under-test-a"
+	serviceName := "my-service-under-test"
+	ecsService := &mock.ECSService{}
+	rootCmd.SetArgs([]string{"service", "-c", clusterName, "--container", "app", "--revision", "3", serviceName})
+	serviceCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeServiceRunE(ecsService)
+		return nil
+	}
+	defer serviceCmd.Flags().Set("revision", "0")
+	defer serviceCmd.Flags().Set("container", "")
+	err := rootCmd.Execute()
+	if err != nil {
+		t.Log("running Execute():", err)
+		t.FailNow()
+	}
+	if ecsService.Container != "app" || ecsService.Version != "3" {
+		t.Fatal("wrong container rollback:", ecsService.Container, ecsService.Version)
+	}
+}
+
+func TestServiceRollbackMany(t *testing.T) {
+	clusterName := "my-cluster-under-test-a"
+	dir, err := ioutil.TempDir("", "ecsundo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, "services")
+	err = ioutil.WriteFile(filePath, []byte("# checkout\nbasket\n\npayments\napi\n"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecsService := &mock.ECSService{}
+	var buf bytes.Buffer
+	rootCmd.SetOutput(&buf)
+	defer rootCmd.SetOutput(nil)
+	rootCmd.SetArgs([]string{"service", "-c", clusterName, "--image-tag", "abc123", "--services-file", filePath, "api", "web"})
+	serviceCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeServiceRunE(ecsService)
+		return nil
+	}
+	defer serviceCmd.Flags().Set("image-tag", "")
+	defer serviceCmd.Flags().Set("services-file", "")
+	err = rootCmd.Execute()
+	if err != nil {
+		t.Fatal("running Execute():", err)
+	}
+	if strings.Join(ecsService.Services, ",") != "api,web,basket,payments" {
+		t.Fatal("wrong services:", ecsService.Services)
+	}
+	if ecsService.Options.Images["basket"] != "abc123" {
+		t.Fatal("wrong images:", ecsService.Options.Images)
+	}
+	if !strings.Contains(buf.String(), "payments: payments:2 -> payments:1") {
+		t.Fatal("missing report:", buf.String())
+	}
+}
+
+func TestServiceRollbackCheckTargets(t *testing.T) {
+	clusterName := "my-cluster-under-test-a"
+	serviceName := "my-service-under-test"
+	ecsService := &mock.ECSService{}
+	rootCmd.SetArgs([]string{"service", "-c", clusterName, "--check-targets", "--revision", "3", serviceName})
+	serviceCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeServiceRunE(ecsService)
+		return nil
+	}
+	defer serviceCmd.Flags().Set("revision", "0")
+	defer rootCmd.PersistentFlags().Set("check-targets", "false")
+	err := rootCmd.Execute()
+	if err != nil {
+		t.Fatal("running Execute():", err)
+	}
+	if len(ecsService.HealthChecked) != 1 || ecsService.HealthChecked[0] != serviceName {
+		t.Fatal("targets health not checked:", ecsService.HealthChecked)
+	}
+}
+
+func TestServiceRollbackInProgress(t *testing.T) {
+	clusterName := "my-cluster-under-test-a"
+	serviceName := "my-service-under-test"
+	ecsService := &mock.ECSService{InProgress: []string{serviceName}}
+	serviceCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeServiceRunE(ecsService)
+		return nil
+	}
+	defer serviceCmd.Flags().Set("revision", "0")
+	rootCmd.SetArgs([]string{"service", "-c", clusterName, "--revision", "3", serviceName})
+	err := rootCmd.Execute()
+	if err == nil || !strings.Contains(err.Error(), "deployment in progress") {
+		t.Fatal("deployment in progress not refused:", err)
+	}
+	if ecsService.Version != "" {
+		t.Fatal("service changed:", ecsService.Version)
+	}
+
+	rootCmd.SetArgs([]string{"service", "-c", clusterName, "--revision", "3", "--wait-deployments", serviceName})
+	defer rootCmd.PersistentFlags().Set("wait-deployments", "false")
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatal("running Execute():", err)
+	}
+	if len(ecsService.Waited) != 1 || aws.ServiceName(ecsService.Waited[0]) != serviceName {
+		t.Fatal("deployment not waited for:", ecsService.Waited)
+	}
+	rootCmd.PersistentFlags().Set("wait-deployments", "false")
+
+	ecsService.Version = ""
+	rootCmd.SetArgs([]string{"service", "-c", clusterName, "--revision", "3", "--force", serviceName})
+	defer rootCmd.PersistentFlags().Set("force", "false")
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatal("running Execute():", err)
+	}
+	if ecsService.Version == "" {
+		t.Fatal("service not changed")
+	}
+}
+
+func TestServiceRollbackBarrier(t *testing.T) {
+	clusterName := "my-cluster-under-test-a"
+	serviceName := "my-service-under-test"
+	ecsService := &mock.ECSService{Barrier: "app:8"}
+	serviceCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeServiceRunE(ecsService)
+		return nil
+	}
+	defer serviceCmd.Flags().Set("revision", "0")
+	rootCmd.SetArgs([]string{"service", "-c", clusterName, "--revision", "3", serviceName})
+	err := rootCmd.Execute()
+	if err == nil || !strings.Contains(err.Error(), "app:8") {
+		t.Fatal("barrier not honoured:", err)
+	}
+	if ecsService.Version != "" {
+		t.Fatal("service changed:", ecsService.Version)
+	}
+
+	rootCmd.SetArgs([]string{"service", "-c", clusterName, "--revision", "3", "--allow-barrier", serviceName})
+	defer rootCmd.PersistentFlags().Set("allow-barrier", "false")
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatal("running Execute():", err)
+	}
+	if ecsService.Version == "" {
+		t.Fatal("service not changed")
+	}
+}
+
+func TestServiceRollbackPrintsStrategy(t *testing.T) {
+	ecsService := &mock.ECSService{}
+	var buf bytes.Buffer
+	rootCmd.SetOutput(&buf)
+	defer rootCmd.SetOutput(nil)
+	rootCmd.SetArgs([]string{"service", "-c", "my-cluster-under-test-strategy", "my-service-under-test"})
+	serviceCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		cmd.RunE = makeServiceRunE(ecsService)
+		return nil
+	}
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatal("running Execute():", err)
+	}
+	if !strings.Contains(buf.String(), "my-service-under-test: ") || !strings.Contains(buf.String(), "(deployment history)") {
+		t.Fatal("strategy not shown:", buf.String())
+	}
+}
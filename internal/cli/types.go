@@ -20,18 +20,71 @@
 
 package cli
 
-import "github.com/eraclitux/ecsundo/internal/platform/aws"
+import (
+	"time"
+
+	"github.com/eraclitux/ecsundo/internal/lock"
+	"github.com/eraclitux/ecsundo/internal/platform/aws"
+)
 
 // ecsProvider models an interface on AWS ECS service apis.
 type ecsProvider interface {
-	// ServicePreviousVersion returns previous task version as ARN string.
-	ServicePreviousVersion(serviceName, clusterName string) (string, error)
+	// ServicePreviousVersion returns as ARN string the task version deployed
+	// steps versions before the current one, and how it has been found.
+	ServicePreviousVersion(serviceName, clusterName string, steps int) (string, string, error)
+	// ServiceVersion returns the ARN of a task version of the service family
+	// given as revision number, family:revision or ARN.
+	ServiceVersion(serviceName, clusterName, taskDefinition string) (string, error)
+	// ServiceImageVersion returns the most recent task version of the service
+	// family running an image that matches the reference.
+	ServiceImageVersion(serviceName, clusterName, imageRef string) (string, error)
+	// ServiceHistory returns the most recent revisions of the task family the
+	// service runs.
+	ServiceHistory(serviceName, clusterName string, limit int) ([]aws.TaskVersion, error)
 	// ServiceRollback updates a service to use a specific task version.
-	ServiceRollback(serviceName, clusterName, taskARN string) error
+	ServiceRollback(serviceName, clusterName, taskARN string) (aws.ServiceChange, error)
+	// ServicesRollback updates several services in a cluster to their
+	// previous versions, or to the versions running images in options.
+	ServicesRollback(serviceNames []string, clusterName string, opts aws.RollbackOptions) ([]aws.ServiceChange, error)
+	// PlanRollback returns the changes rolling back services would make,
+	// without making them.
+	PlanRollback(servicesInfo []aws.ServiceInfo, clusterName string, opts aws.RollbackOptions) ([]aws.PlannedChange, error)
+	// ServiceContainerRollback updates a service to a new task version, with
+	// only the image of a container taken from the given one.
+	ServiceContainerRollback(serviceName, clusterName, taskARN, containerName string, withEnv bool) (aws.ServiceChange, error)
 	// ClusterRollback updates all services in a given cluster.
-	ClusterRollback(clusterName string) error
+	ClusterRollback(clusterName string, opts aws.RollbackOptions) ([]aws.ServiceChange, error)
+	// ClusterTargets returns the task versions ClusterRollback would update
+	// services to.
+	ClusterTargets(clusterName string, opts aws.RollbackOptions) ([]aws.ServiceInfo, error)
+	// ServiceDiff compares the task definition a service runs with the given one.
+	ServiceDiff(serviceName, clusterName, taskARN string) (aws.TaskDiff, error)
+	// ClusterStateAt returns task versions services selected by filter were
+	// running at a given time and services whose history does not go back
+	// to it.
+	ClusterStateAt(clusterName string, at time.Time, filter aws.ServiceFilter) ([]aws.ServiceInfo, []string, error)
+	// FilterServices returns services selected by filter.
+	FilterServices(servicesInfo []aws.ServiceInfo, clusterName string, filter aws.ServiceFilter) ([]aws.ServiceInfo, error)
 	// ClusterSnapshot returns current task versions for all services.
 	ClusterSnapshot(clusterName string) ([]aws.ServiceInfo, error)
 	// ClusterRestore restores all services to specific versions.
-	ClusterRestore(serviceSnapshots []aws.ServiceInfo, clusterName string) error
+	ClusterRestore(serviceSnapshots []aws.ServiceInfo, clusterName string, opts aws.RollbackOptions) ([]aws.ServiceChange, error)
+	// WaitTargetsHealthy waits until targets of the service tasks running a
+	// task version are healthy in the service load balancers.
+	WaitTargetsHealthy(serviceName, clusterName, taskARN string, timeout time.Duration) error
+	// ServicesState returns the rollout state of services.
+	ServicesState(serviceNames []string, clusterName string) ([]aws.ServiceState, error)
+	// CheckDeployments returns an error if any service has a deployment in
+	// progress, or waits for deployments to settle as set in options.
+	CheckDeployments(serviceNames []string, clusterName string, opts aws.RollbackOptions) error
+	// CheckBarriers returns an error if rolling back services to their task
+	// versions would cross a barrier.
+	CheckBarriers(servicesInfo []aws.ServiceInfo, clusterName string, opts aws.RollbackOptions) error
+	// Locker returns a lock.Locker using an AWS backend, dynamodb or tag.
+	Locker(backend, table string) (lock.Locker, error)
+	// CallerIdentity returns the ARN of the AWS identity requests are made
+	// with.
+	CallerIdentity() (string, error)
+	// Region returns the AWS region services are in.
+	Region() string
 }
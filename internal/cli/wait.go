@@ -0,0 +1,161 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/eraclitux/ecsundo/internal/platform/aws"
+	"github.com/spf13/cobra"
+)
+
+// pollInterval is the time between checks of services state.
+var pollInterval = 10 * time.Second
+
+// healthTimeout returns the time to wait for load balancer targets of
+// rolled back services to be healthy, zero if --check-targets is not given.
+func healthTimeout(cmd *cobra.Command) (time.Duration, error) {
+	checkTargets, err := cmd.Flags().GetBool("check-targets")
+	if err != nil || !checkTargets {
+		return 0, err
+	}
+	return cmd.Flags().GetDuration("timeout")
+}
+
+// deploymentOptions sets in opts how services with a deployment in progress
+// are handled: refused, changed anyway with --force or waited for with
+// --wait-deployments. It also stops changes if the cluster lock is lost.
+func deploymentOptions(cmd *cobra.Command, ecs ecsProvider, clusterName string, opts *aws.RollbackOptions) error {
+	force, err := cmd.Flags().GetBool("force")
+	if err != nil {
+		return err
+	}
+	waitDeployments, err := cmd.Flags().GetBool("wait-deployments")
+	if err != nil {
+		return err
+	}
+	if force && waitDeployments {
+		return errors.New("--force cannot be used with --wait-deployments")
+	}
+	timeout, err := cmd.Flags().GetDuration("timeout")
+	if err != nil {
+		return err
+	}
+	opts.Force = force
+	opts.Proceed = func() error {
+		return checkLock(clusterName)
+	}
+	if waitDeployments {
+		out := cmd.OutOrStdout()
+		opts.WaitDeployments = func(serviceARNs []string) error {
+			return waitStable(ecs, clusterName, serviceARNs, timeout, out)
+		}
+	}
+	return nil
+}
+
+// waitChanges waits until changed services are stable if --wait is given.
+func waitChanges(cmd *cobra.Command, ecs ecsProvider, clusterName string, changes []aws.ServiceChange) error {
+	wait, err := cmd.Flags().GetBool("wait")
+	if err != nil {
+		return err
+	}
+	if !wait || len(changes) == 0 {
+		return nil
+	}
+	timeout, err := cmd.Flags().GetDuration("timeout")
+	if err != nil {
+		return err
+	}
+	err = waitStable(ecs, clusterName, changedServices(changes), timeout, cmd.OutOrStdout())
+	if err != nil {
+		return fmt.Errorf("error for %q: %s", clusterName, err)
+	}
+	return nil
+}
+
+// changedServices returns the services changed.
+func changedServices(changes []aws.ServiceChange) []string {
+	serviceNames := make([]string, 0, len(changes))
+	for _, change := range changes {
+		serviceNames = append(serviceNames, change.ARN)
+	}
+	return serviceNames
+}
+
+// waitStable polls services until their primary deployment is stable,
+// printing their rollout state when it changes. It fails if a deployment
+// fails or if services are not stable within timeout.
+func waitStable(ecs ecsProvider, clusterName string, serviceNames []string, timeout time.Duration, out io.Writer) error {
+	deadline := time.Now().Add(timeout)
+	pending := serviceNames
+	lastStatus := make(map[string]string, len(serviceNames))
+	var failedServices []string
+	for len(pending) > 0 {
+		states, err := ecs.ServicesState(pending, clusterName)
+		if err != nil {
+			return err
+		}
+		pending = make([]string, 0, len(states))
+		for _, state := range states {
+			name := aws.ServiceName(state.ARN)
+			status := fmt.Sprintf("%s, %d/%d tasks running", valueOrDash(state.RolloutState), state.Running, state.Desired)
+			if state.RolloutStateReason != "" {
+				status += ", " + state.RolloutStateReason
+			}
+			if lastStatus[name] != status {
+				fmt.Fprintf(out, "%s %s: %s\n", time.Now().Format("15:04:05"), name, status)
+				lastStatus[name] = status
+			}
+			switch {
+			case state.Failed():
+				failedServices = append(failedServices, fmt.Sprintf("%q: %s", name, valueOrDash(state.RolloutStateReason)))
+			case !state.Stable():
+				pending = append(pending, state.ARN)
+			}
+		}
+		if len(pending) == 0 {
+			break
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			for _, service := range pending {
+				failedServices = append(failedServices, fmt.Sprintf("%q: not stable after %s", aws.ServiceName(service), timeout))
+			}
+			break
+		}
+		if wait > pollInterval {
+			wait = pollInterval
+		}
+		time.Sleep(wait)
+	}
+	if len(failedServices) > 0 {
+		return fmt.Errorf(
+			"these services did not stabilise:\n%s",
+			strings.Join(failedServices, "\n"),
+		)
+	}
+	return nil
+}
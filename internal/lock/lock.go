@@ -0,0 +1,269 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package lock prevents concurrent changes to the same cluster by different
+// ecsundo runs.
+package lock
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+)
+
+// Info describes a lock and who holds it.
+type Info struct {
+	// ID identifies the run holding the lock.
+	ID         string    `json:"id"`
+	Holder     string    `json:"holder"`
+	Command    string    `json:"command"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// Expired reports whether the lock is expired at time now.
+func (i Info) Expired(now time.Time) bool {
+	return !now.Before(i.ExpiresAt)
+}
+
+// NewInfo returns lock information for the current user and host, expiring
+// after ttl.
+func NewInfo(command string, ttl time.Duration) Info {
+	holder := "unknown"
+	if u, err := user.Current(); err == nil {
+		holder = u.Username
+	}
+	if host, err := os.Hostname(); err == nil {
+		holder += "@" + host
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	now := time.Now().UTC()
+	return Info{
+		ID:         hex.EncodeToString(id),
+		Holder:     fmt.Sprintf("%s (pid %d)", holder, os.Getpid()),
+		Command:    command,
+		AcquiredAt: now,
+		ExpiresAt:  now.Add(ttl),
+	}
+}
+
+// LockedError is returned when a cluster is locked by someone else.
+type LockedError struct {
+	Cluster string
+	Info    Info
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf(
+		"cluster %q is locked by %s running %q since %s, lock expires at %s",
+		e.Cluster, e.Info.Holder, e.Info.Command,
+		e.Info.AcquiredAt.Local().Format(time.RFC3339),
+		e.Info.ExpiresAt.Local().Format(time.RFC3339),
+	)
+}
+
+// Locker acquires and releases locks on clusters. Expired locks can be
+// acquired by anyone.
+type Locker interface {
+	// Acquire locks a cluster, it returns a *LockedError if the cluster is
+	// already locked.
+	Acquire(cluster string, info Info) error
+	// Refresh extends the lock of a cluster held with info until
+	// info.ExpiresAt, it returns a *LockedError if someone else holds it.
+	Refresh(cluster string, info Info) error
+	// Release unlocks a cluster if it is locked with info.
+	Release(cluster string, info Info) error
+	// Status returns the lock of a cluster, nil if it is not locked.
+	Status(cluster string) (*Info, error)
+	// Break unlocks a cluster whoever holds the lock.
+	Break(cluster string) error
+}
+
+// FileLocker keeps locks in local files, it only prevents concurrent runs
+// on the same host.
+type FileLocker struct {
+	dir string
+}
+
+// NewFileLocker returns a Locker keeping lock files in dir.
+func NewFileLocker(dir string) *FileLocker {
+	return &FileLocker{dir: dir}
+}
+
+func (fl *FileLocker) path(cluster string) string {
+	return filepath.Join(fl.dir, "."+cluster+".ecsundo.lock")
+}
+
+// Acquire creates the lock file of a cluster, linking in place a temporary
+// file already written so that the lock is never read partially written. An
+// expired lock file is first moved away with a rename: only one run can
+// move it, the others find it gone and try again to create the lock.
+func (fl *FileLocker) Acquire(cluster string, info Info) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	tmp, err := fl.temp(cluster, data)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	for {
+		err := os.Link(tmp, fl.path(cluster))
+		if err == nil {
+			return nil
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		current, err := fl.Status(cluster)
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			// Released in the meantime, try again.
+			continue
+		}
+		if !current.Expired(time.Now()) {
+			return &LockedError{Cluster: cluster, Info: *current}
+		}
+		if err := fl.removeExpired(cluster, *current, tmp+".expired"); err != nil {
+			return err
+		}
+	}
+}
+
+// removeExpired moves away the lock file of a cluster, renaming it to a name
+// owned by the caller, if it still holds the expired lock. A lock acquired
+// by someone else in the meantime is put back, a *LockedError is returned
+// if it cannot be.
+func (fl *FileLocker) removeExpired(cluster string, expired Info, moved string) error {
+	err := os.Rename(fl.path(cluster), moved)
+	if os.IsNotExist(err) {
+		// Moved away by someone else.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer os.Remove(moved)
+	data, err := ioutil.ReadFile(moved)
+	if err != nil {
+		return err
+	}
+	var info Info
+	if err := json.Unmarshal(data, &info); err == nil && info.ID == expired.ID {
+		return nil
+	}
+	// The lock has been acquired after it was read expired.
+	if err := os.Link(moved, fl.path(cluster)); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return &LockedError{Cluster: cluster, Info: info}
+}
+
+// Refresh rewrites the lock file of a cluster if it holds info.
+func (fl *FileLocker) Refresh(cluster string, info Info) error {
+	current, err := fl.Status(cluster)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return fmt.Errorf("lock of %q has been released", cluster)
+	}
+	if current.ID != info.ID {
+		return &LockedError{Cluster: cluster, Info: *current}
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	tmp, err := fl.temp(cluster, data)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, fl.path(cluster)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// temp writes data to a new temporary file next to the lock file of a
+// cluster and returns its path.
+func (fl *FileLocker) temp(cluster string, data []byte) (string, error) {
+	f, err := ioutil.TempFile(fl.dir, filepath.Base(fl.path(cluster))+".")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0640)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// Release removes the lock file of a cluster if it holds info.
+func (fl *FileLocker) Release(cluster string, info Info) error {
+	current, err := fl.Status(cluster)
+	if err != nil || current == nil || current.ID != info.ID {
+		return err
+	}
+	return fl.Break(cluster)
+}
+
+// Status reads the lock file of a cluster.
+func (fl *FileLocker) Status(cluster string) (*Info, error) {
+	data, err := ioutil.ReadFile(fl.path(cluster))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var info Info
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("invalid lock file %s: %s", fl.path(cluster), err)
+	}
+	return &info, nil
+}
+
+// Break removes the lock file of a cluster.
+func (fl *FileLocker) Break(cluster string) error {
+	err := os.Remove(fl.path(cluster))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,167 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package lock
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileLocker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ecsundo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	locker := NewFileLocker(dir)
+	first := NewInfo("cluster", time.Hour)
+	if err := locker.Acquire("prod", first); err != nil {
+		t.Fatal("acquiring free lock:", err)
+	}
+	second := NewInfo("cluster restore", time.Hour)
+	err = locker.Acquire("prod", second)
+	if e, ok := err.(*LockedError); !ok || e.Info.ID != first.ID {
+		t.Fatal("lock acquired twice:", err)
+	}
+	if err := locker.Acquire("staging", second); err != nil {
+		t.Fatal("acquiring lock of another cluster:", err)
+	}
+	// Releasing a lock held by someone else does nothing.
+	if err := locker.Release("prod", second); err != nil {
+		t.Fatal(err)
+	}
+	info, err := locker.Status("prod")
+	if err != nil || info == nil || info.ID != first.ID {
+		t.Fatal("wrong status:", info, err)
+	}
+	if err := locker.Release("prod", first); err != nil {
+		t.Fatal(err)
+	}
+	info, err = locker.Status("prod")
+	if err != nil || info != nil {
+		t.Fatal("lock not released:", info, err)
+	}
+}
+
+func TestFileLockerExpired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ecsundo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	locker := NewFileLocker(dir)
+	if err := locker.Acquire("prod", NewInfo("cluster", -time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	info := NewInfo("cluster", time.Hour)
+	if err := locker.Acquire("prod", info); err != nil {
+		t.Fatal("expired lock not acquired:", err)
+	}
+	if status, _ := locker.Status("prod"); status == nil || status.ID != info.ID {
+		t.Fatal("expired lock not replaced:", status)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Fatal("temporary files left:", len(files))
+	}
+	if err := locker.Break("prod"); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := locker.Status("prod"); status != nil {
+		t.Fatal("lock not broken:", status)
+	}
+}
+
+func TestFileLockerConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ecsundo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	locker := NewFileLocker(dir)
+	for round := 0; round < 50; round++ {
+		if err := locker.Acquire("prod", NewInfo("cluster", -time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		const runs = 8
+		errs := make([]error, runs)
+		var wg sync.WaitGroup
+		for i := 0; i < runs; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = locker.Acquire("prod", NewInfo("cluster", time.Hour))
+			}(i)
+		}
+		wg.Wait()
+		acquired := 0
+		for _, err := range errs {
+			switch err.(type) {
+			case nil:
+				acquired++
+			case *LockedError:
+			default:
+				t.Fatal("unexpected error:", err)
+			}
+		}
+		if acquired != 1 {
+			t.Fatalf("round %d: expired lock acquired by %d runs", round, acquired)
+		}
+		if err := locker.Break("prod"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatal("temporary files left:", len(files))
+	}
+}
+
+func TestFileLockerRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ecsundo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	locker := NewFileLocker(dir)
+	info := NewInfo("cluster", time.Minute)
+	if err := locker.Acquire("prod", info); err != nil {
+		t.Fatal(err)
+	}
+	info.ExpiresAt = info.ExpiresAt.Add(time.Hour)
+	if err := locker.Refresh("prod", info); err != nil {
+		t.Fatal("refreshing lock:", err)
+	}
+	if status, _ := locker.Status("prod"); status == nil || !status.ExpiresAt.Equal(info.ExpiresAt) {
+		t.Fatal("lock not refreshed:", status)
+	}
+	other := NewInfo("cluster restore", time.Hour)
+	if _, ok := locker.Refresh("prod", other).(*LockedError); !ok {
+		t.Fatal("lock held by someone else refreshed")
+	}
+	if err := locker.Release("prod", info); err != nil {
+		t.Fatal(err)
+	}
+	if err := locker.Refresh("prod", info); err == nil {
+		t.Fatal("released lock refreshed")
+	}
+}
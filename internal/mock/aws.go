@@ -1,33 +1,241 @@
 package mock
 
-import "github.com/eraclitux/ecsundo/internal/platform/aws"
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/eraclitux/ecsundo/internal/lock"
+	"github.com/eraclitux/ecsundo/internal/platform/aws"
+)
 
 type ECSService struct {
 	ServiceName string
 	ClusterName string
 	Version     string
+	Steps       int
+	Options     aws.RollbackOptions
+	Restored    []aws.ServiceInfo
+	Container   string
+	At          time.Time
+	Filter      aws.ServiceFilter
+	Services    []string
+	Planned     []aws.ServiceInfo
+	// RolloutState is reported for every service by ServicesState.
+	RolloutState string
+	Waited       []string
+	// HealthChecked lists services WaitTargetsHealthy was called for.
+	HealthChecked []string
+	// InProgress lists services having a deployment in progress.
+	InProgress []string
+	// Barrier, if not empty, blocks every rollback.
+	Barrier string
+	// Snapshot is returned by ClusterSnapshot.
+	Snapshot []aws.ServiceInfo
+	// AtFilter is the filter ClusterStateAt is called with.
+	AtFilter aws.ServiceFilter
+	// Skipped is returned by ClusterStateAt as services with no history.
+	Skipped []string
+}
+
+func (ecs *ECSService) ServicesState(serviceNames []string, clusterName string) ([]aws.ServiceState, error) {
+	ecs.Waited = serviceNames
+	states := make([]aws.ServiceState, 0, len(serviceNames))
+	for _, name := range serviceNames {
+		states = append(states, aws.ServiceState{
+			ARN:          name,
+			RolloutState: ecs.RolloutState,
+			Running:      2,
+			Desired:      2,
+			Deployments:  1,
+		})
+	}
+	return states, nil
+}
+
+// CheckDeployments reports services in InProgress with their ARNs, as ECS
+// does, unless they are being redone.
+func (ecs *ECSService) CheckDeployments(serviceNames []string, clusterName string, opts aws.RollbackOptions) error {
+	busy := make([]string, 0, len(ecs.InProgress))
+	for _, name := range ecs.InProgress {
+		serviceARN := "arn:aws:ecs:us-east-1:123456789012:service/" + clusterName + "/" + name
+		if _, ok := opts.Redoing[aws.ServiceName(serviceARN)]; !ok {
+			busy = append(busy, serviceARN)
+		}
+	}
+	if opts.Force || len(busy) == 0 {
+		return nil
+	}
+	if opts.WaitDeployments != nil {
+		return opts.WaitDeployments(busy)
+	}
+	return errors.New("these services have a deployment in progress: " + strings.Join(busy, ", "))
+}
+
+func (ecs *ECSService) CheckBarriers(servicesInfo []aws.ServiceInfo, clusterName string, opts aws.RollbackOptions) error {
+	if opts.AllowBarrier || ecs.Barrier == "" {
+		return nil
+	}
+	return errors.New("rollback blocked by barrier " + ecs.Barrier)
+}
+
+func (ecs *ECSService) WaitTargetsHealthy(serviceName, clusterName, taskARN string, timeout time.Duration) error {
+	ecs.HealthChecked = append(ecs.HealthChecked, serviceName)
+	return nil
+}
+
+func (ecs *ECSService) Locker(backend, table string) (lock.Locker, error) {
+	return nil, errors.New("lock backend not supported by mock")
+}
+
+func (ecs *ECSService) CallerIdentity() (string, error) {
+	return "arn:aws:iam::123456789012:user/tester", nil
 }
 
-func (ecs *ECSService) ServicePreviousVersion(serviceName, clusterName string) (string, error) {
+func (ecs *ECSService) Region() string {
+	return "us-east-1"
+}
+
+func (ecs *ECSService) ServicePreviousVersion(serviceName, clusterName string, steps int) (string, string, error) {
 	ecs.ServiceName = serviceName
 	ecs.ClusterName = clusterName
-	return "", nil
+	ecs.Steps = steps
+	return "", aws.FromHistory, nil
 }
 
-func (ecs *ECSService) ServiceRollback(serviceName, clusterName, version string) error {
+func (ecs *ECSService) ServiceVersion(serviceName, clusterName, taskDefinition string) (string, error) {
+	ecs.ServiceName = serviceName
+	ecs.ClusterName = clusterName
+	return taskDefinition, nil
+}
+
+func (ecs *ECSService) ServiceImageVersion(serviceName, clusterName, imageRef string) (string, error) {
+	ecs.ServiceName = serviceName
+	ecs.ClusterName = clusterName
+	return imageRef, nil
+}
+
+func (ecs *ECSService) ServiceHistory(serviceName, clusterName string, limit int) ([]aws.TaskVersion, error) {
+	ecs.ServiceName = serviceName
+	ecs.ClusterName = clusterName
+	return []aws.TaskVersion{
+		{ARN: "arn:aws:ecs:us-east-1:123456789012:task-definition/app:2", Status: "ACTIVE", Images: []string{"app:def"}, Current: true},
+		{ARN: "arn:aws:ecs:us-east-1:123456789012:task-definition/app:1", Status: "INACTIVE", Images: []string{"app:abc"}},
+	}, nil
+}
+
+func (ecs *ECSService) ServiceRollback(serviceName, clusterName, version string) (aws.ServiceChange, error) {
 	ecs.Version = version
-	return nil
+	return aws.ServiceChange{ARN: serviceName, ToTaskARN: version}, nil
 }
 
-func (ecs *ECSService) ClusterRollback(clusterName string) error {
+func (ecs *ECSService) ServicesRollback(serviceNames []string, clusterName string, opts aws.RollbackOptions) ([]aws.ServiceChange, error) {
+	if err := ecs.CheckBarriers(nil, clusterName, opts); err != nil {
+		return nil, err
+	}
+	ecs.Services = serviceNames
 	ecs.ClusterName = clusterName
-	return nil
+	ecs.Options = opts
+	changes := make([]aws.ServiceChange, 0, len(serviceNames))
+	for _, name := range serviceNames {
+		changes = append(changes, aws.ServiceChange{
+			ARN:         name,
+			FromTaskARN: "arn:aws:ecs:us-east-1:123456789012:task-definition/" + name + ":2",
+			ToTaskARN:   "arn:aws:ecs:us-east-1:123456789012:task-definition/" + name + ":1",
+		})
+	}
+	return changes, nil
 }
 
-func (ecs *ECSService) ClusterSnapshot(clusterName string) ([]aws.ServiceInfo, error) {
+func (ecs *ECSService) PlanRollback(servicesInfo []aws.ServiceInfo, clusterName string, opts aws.RollbackOptions) ([]aws.PlannedChange, error) {
+	if err := ecs.CheckBarriers(servicesInfo, clusterName, opts); err != nil {
+		return nil, err
+	}
+	ecs.ClusterName = clusterName
+	ecs.Planned = servicesInfo
+	ecs.Options = opts
+	plan := make([]aws.PlannedChange, 0, len(servicesInfo))
+	for _, s := range servicesInfo {
+		plan = append(plan, aws.PlannedChange{
+			ARN:         s.ARN,
+			FromTaskARN: "arn:aws:ecs:us-east-1:123456789012:task-definition/app:2",
+			ToTaskARN:   "arn:aws:ecs:us-east-1:123456789012:task-definition/app:1",
+			Register:    true,
+		})
+	}
+	return plan, nil
+}
+
+func (ecs *ECSService) ServiceContainerRollback(serviceName, clusterName, version, containerName string, withEnv bool) (aws.ServiceChange, error) {
+	ecs.Version = version
+	ecs.Container = containerName
+	return aws.ServiceChange{ARN: serviceName, ToTaskARN: version, RegisteredTaskARN: version + "-new"}, nil
+}
+
+func (ecs *ECSService) ClusterRollback(clusterName string, opts aws.RollbackOptions) ([]aws.ServiceChange, error) {
+	if err := ecs.CheckBarriers(nil, clusterName, opts); err != nil {
+		return nil, err
+	}
+	ecs.ClusterName = clusterName
+	ecs.Options = opts
 	return nil, nil
 }
 
-func (ecs *ECSService) ClusterRestore(serviceSnapshots []aws.ServiceInfo, clusterName string) error {
-	return nil
+func (ecs *ECSService) ClusterTargets(clusterName string, opts aws.RollbackOptions) ([]aws.ServiceInfo, error) {
+	ecs.ClusterName = clusterName
+	ecs.Options = opts
+	return []aws.ServiceInfo{{ARN: "my-service", TaskARN: "task-a:1"}}, nil
+}
+
+func (ecs *ECSService) ServiceDiff(serviceName, clusterName, taskARN string) (aws.TaskDiff, error) {
+	return aws.TaskDiff{
+		ServiceARN:  serviceName,
+		FromTaskARN: "arn:aws:ecs:us-east-1:123456789012:task-definition/app:2",
+		ToTaskARN:   taskARN,
+		Changes:     []aws.DiffEntry{{Field: "containers[app].image", From: "app:def", To: "app:abc"}},
+	}, nil
+}
+
+func (ecs *ECSService) ClusterStateAt(clusterName string, at time.Time, filter aws.ServiceFilter) ([]aws.ServiceInfo, []string, error) {
+	ecs.ClusterName = clusterName
+	ecs.At = at
+	ecs.AtFilter = filter
+	return []aws.ServiceInfo{{ARN: "my-service", TaskARN: "task-a:1"}}, ecs.Skipped, nil
+}
+
+// FilterServices selects services whose name is one of filter includes,
+// patterns are not supported.
+func (ecs *ECSService) FilterServices(servicesInfo []aws.ServiceInfo, clusterName string, filter aws.ServiceFilter) ([]aws.ServiceInfo, error) {
+	ecs.Filter = filter
+	if len(filter.Include) == 0 {
+		return servicesInfo, nil
+	}
+	filtered := make([]aws.ServiceInfo, 0, len(servicesInfo))
+	for _, s := range servicesInfo {
+		for _, name := range filter.Include {
+			if aws.ServiceName(s.ARN) == name {
+				filtered = append(filtered, s)
+				break
+			}
+		}
+	}
+	return filtered, nil
+}
+
+func (ecs *ECSService) ClusterSnapshot(clusterName string) ([]aws.ServiceInfo, error) {
+	return ecs.Snapshot, nil
+}
+
+func (ecs *ECSService) ClusterRestore(serviceSnapshots []aws.ServiceInfo, clusterName string, opts aws.RollbackOptions) ([]aws.ServiceChange, error) {
+	if err := ecs.CheckBarriers(serviceSnapshots, clusterName, opts); err != nil {
+		return nil, err
+	}
+	ecs.ClusterName = clusterName
+	ecs.Options = opts
+	ecs.Restored = serviceSnapshots
+	changes := make([]aws.ServiceChange, 0, len(serviceSnapshots))
+	for _, s := range serviceSnapshots {
+		changes = append(changes, aws.ServiceChange{ARN: s.ARN, ToTaskARN: s.TaskARN})
+	}
+	return changes, nil
 }
@@ -0,0 +1,140 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package aws
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// barrierTag marks a task definition revision services cannot be rolled
+// back past, e.g. because it runs irreversible database migrations. Its
+// value, if any, tells why.
+const barrierTag = "ecsundo:barrier"
+
+// CheckBarriers returns an error if rolling back services to their task
+// versions would cross a barrier: a revision newer than the target, up to the
+// current one, that is tagged with ecsundo:barrier or listed in options
+// Barriers. Nothing is checked if options set AllowBarrier.
+func (es *ECSService) CheckBarriers(servicesInfo []ServiceInfo, clusterName string, opts RollbackOptions) error {
+	if opts.AllowBarrier {
+		return nil
+	}
+	blocked := make([]string, len(servicesInfo))
+	es.forEach(len(servicesInfo), func(i int) {
+		service := servicesInfo[i]
+		currentARN, err := es.getCurrentTask(service.ARN, clusterName)
+		if err != nil {
+			blocked[i] = fmt.Sprintf("%q: %s", ServiceName(service.ARN), fmt.Errorf(awsApisErrorFmt, err))
+			return
+		}
+		barrier, reason, err := es.crossedBarrier(currentARN, service.TaskARN, opts.Barriers)
+		switch {
+		case err != nil:
+			blocked[i] = fmt.Sprintf("%q: %s", ServiceName(service.ARN), err)
+		case barrier != "":
+			blocked[i] = fmt.Sprintf(
+				"%q: %s -> %s crosses barrier %s (%s)",
+				ServiceName(service.ARN), TaskName(currentARN), TaskName(service.TaskARN), barrier, reason,
+			)
+		}
+	})
+	report := make([]string, 0, len(blocked))
+	for _, b := range blocked {
+		if b != "" {
+			report = append(report, b)
+		}
+	}
+	if len(report) == 0 {
+		return nil
+	}
+	sort.Strings(report)
+	return fmt.Errorf(
+		"no service changed, rollback of these services is blocked by a barrier:\n%s",
+		strings.Join(report, "\n"),
+	)
+}
+
+// crossedBarrier returns a barrier between target and current task versions,
+// and why it is a barrier: the first configured barrier crossed or else the
+// newest revision tagged as barrier. It is empty if there is none.
+func (es *ECSService) crossedBarrier(currentARN, targetARN string, barriers []string) (string, string, error) {
+	for _, barrier := range barriers {
+		if crossesBarrier(currentARN, targetARN, barrier) {
+			return barrier, "marked in configuration", nil
+		}
+	}
+	family, _, err := parseTaskDefinition(currentARN)
+	if err != nil || !crossesBarrier(currentARN, targetARN, currentARN) {
+		// Target is not an older revision of the same family.
+		return "", "", nil
+	}
+	taskARNs, err := es.familyRevisions(family, ecs.TaskDefinitionStatusActive, ecs.TaskDefinitionStatusInactive)
+	if err != nil {
+		return "", "", fmt.Errorf(awsApisErrorFmt, err)
+	}
+	for _, taskARN := range taskARNs {
+		if !crossesBarrier(currentARN, targetARN, taskARN) {
+			continue
+		}
+		out, err := es.client.DescribeTaskDefinition(&ecs.DescribeTaskDefinitionInput{
+			TaskDefinition: aws.String(taskARN),
+			Include:        aws.StringSlice([]string{ecs.TaskDefinitionFieldTags}),
+		})
+		if err != nil {
+			return "", "", fmt.Errorf(awsApisErrorFmt, err)
+		}
+		for _, tag := range out.Tags {
+			if aws.StringValue(tag.Key) != barrierTag {
+				continue
+			}
+			reason := "tagged " + barrierTag
+			if value := aws.StringValue(tag.Value); value != "" {
+				reason += ": " + value
+			}
+			return TaskName(taskARN), reason, nil
+		}
+	}
+	return "", "", nil
+}
+
+// crossesBarrier reports whether going from current to target task version
+// undoes barrier, that is barrier is a revision of the same family newer
+// than target and not newer than current.
+func crossesBarrier(currentARN, targetARN, barrier string) bool {
+	family, current, err := parseTaskDefinition(currentARN)
+	if err != nil {
+		return false
+	}
+	targetFamily, target, err := parseTaskDefinition(targetARN)
+	if err != nil || targetFamily != family {
+		return false
+	}
+	barrierFamily, revision, err := parseTaskDefinition(barrier)
+	if err != nil || barrierFamily != family {
+		return false
+	}
+	return target < revision && revision <= current
+}
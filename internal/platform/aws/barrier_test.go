@@ -0,0 +1,49 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package aws
+
+import "testing"
+
+func Test_crossesBarrier(t *testing.T) {
+	const arn = "arn:aws:ecs:us-east-1:123456789012:task-definition/"
+	tests := []struct {
+		name    string
+		current string
+		target  string
+		barrier string
+		want    bool
+	}{
+		{"older target", arn + "app:10", arn + "app:5", "app:8", true},
+		{"barrier is current", arn + "app:10", arn + "app:5", arn + "app:10", true},
+		{"barrier is target", arn + "app:10", arn + "app:8", "app:8", false},
+		{"barrier before target", arn + "app:10", arn + "app:8", "app:3", false},
+		{"barrier after current", arn + "app:10", arn + "app:8", "app:12", false},
+		{"newer target", arn + "app:5", arn + "app:10", "app:8", false},
+		{"other family", arn + "app:10", arn + "app:5", "web:8", false},
+		{"target of other family", arn + "app:10", arn + "web:5", "app:8", false},
+		{"invalid barrier", arn + "app:10", arn + "app:5", "app", false},
+	}
+	for _, tt := range tests {
+		if got := crossesBarrier(tt.current, tt.target, tt.barrier); got != tt.want {
+			t.Errorf("%s: crossesBarrier() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
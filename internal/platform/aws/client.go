@@ -0,0 +1,88 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package aws
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// DefaultConcurrency is the default number of services worked on at the
+// same time.
+const DefaultConcurrency = 10
+
+// retryer retries throttled requests and retryable errors with exponential
+// backoff and jitter, as the SDK default retryer does, counting retries.
+type retryer struct {
+	client.DefaultRetryer
+	verbose bool
+	retries int64
+}
+
+// RetryRules returns the delay before retrying a request.
+func (r *retryer) RetryRules(req *request.Request) time.Duration {
+	delay := r.DefaultRetryer.RetryRules(req)
+	retries := atomic.AddInt64(&r.retries, 1)
+	if r.verbose {
+		code := "error"
+		if e, ok := req.Error.(awserr.Error); ok {
+			code = e.Code()
+		}
+		fmt.Printf(
+			"%s: %s, retry %d of %d in %s (%d retries so far)\n",
+			req.Operation.Name, code, req.RetryCount+1, r.MaxRetries(),
+			delay.Round(time.Millisecond), retries,
+		)
+	}
+	return delay
+}
+
+// forEach calls fn for every index from 0 to n-1, with at most
+// es.concurrency calls running at the same time. It returns when all calls
+// are done.
+func (es *ECSService) forEach(n int, fn func(i int)) {
+	workers := es.concurrency
+	if workers <= 0 || workers > n {
+		workers = n
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
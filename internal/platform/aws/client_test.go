@@ -0,0 +1,85 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package aws
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+func TestECSService_forEach(t *testing.T) {
+	es := &ECSService{concurrency: 3}
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	called := make([]bool, 20)
+	es.forEach(len(called), func(i int) {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		running--
+		called[i] = true
+		mu.Unlock()
+	})
+	if maxRunning > 3 {
+		t.Errorf("%d calls running at the same time, want at most 3", maxRunning)
+	}
+	for i, ok := range called {
+		if !ok {
+			t.Errorf("fn not called for index %d", i)
+		}
+	}
+}
+
+func Test_retryer(t *testing.T) {
+	r := &retryer{
+		DefaultRetryer: client.DefaultRetryer{
+			NumMaxRetries:    8,
+			MinThrottleDelay: 500 * time.Millisecond,
+			MaxThrottleDelay: 20 * time.Second,
+		},
+	}
+	req := &request.Request{
+		Operation:    &request.Operation{Name: "DescribeServices"},
+		Error:        awserr.New("ThrottlingException", "Rate exceeded", nil),
+		HTTPResponse: &http.Response{StatusCode: 400, Header: http.Header{}},
+	}
+	for i := 0; i < 3; i++ {
+		req.RetryCount = i
+		delay := r.RetryRules(req)
+		if delay < 500*time.Millisecond || delay > 20*time.Second {
+			t.Errorf("retry %d: delay %s out of throttle bounds", i, delay)
+		}
+	}
+	if r.retries != 3 {
+		t.Errorf("retries = %d, want 3", r.retries)
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package aws
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// DiffEntry is a field that differs between two task definitions. From or To
+// are empty if the field is missing in one of them.
+type DiffEntry struct {
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+// TaskDiff lists differences between the task definition a service runs and
+// the one it would be rolled back to.
+type TaskDiff struct {
+	ServiceARN  string      `json:"service"`
+	FromTaskARN string      `json:"from"`
+	ToTaskARN   string      `json:"to"`
+	Changes     []DiffEntry `json:"changes"`
+}
+
+// ServiceDiff compares the task definition a service runs with the given one.
+func (es *ECSService) ServiceDiff(serviceName, clusterName, taskARN string) (TaskDiff, error) {
+	currentARN, err := es.getCurrentTask(serviceName, clusterName)
+	if err != nil {
+		return TaskDiff{}, fmt.Errorf(awsApisErrorFmt, err)
+	}
+	current, err := es.describeTaskDefinition(currentARN)
+	if err != nil {
+		return TaskDiff{}, fmt.Errorf(awsApisErrorFmt, err)
+	}
+	target, err := es.describeTaskDefinition(taskARN)
+	if err != nil {
+		return TaskDiff{}, fmt.Errorf(awsApisErrorFmt, err)
+	}
+	return TaskDiff{
+		ServiceARN:  serviceName,
+		FromTaskARN: currentARN,
+		ToTaskARN:   aws.StringValue(target.TaskDefinitionArn),
+		Changes:     compareTaskDefinitions(current, target),
+	}, nil
+}
+
+// compareTaskDefinitions returns fields that differ between two task
+// definitions: task resources and roles, volumes and, for every container,
+// image, resources, environment, secrets references and port mappings.
+func compareTaskDefinitions(from, to *ecs.TaskDefinition) []DiffEntry {
+	d := &differ{}
+	d.compare("cpu", aws.StringValue(from.Cpu), aws.StringValue(to.Cpu))
+	d.compare("memory", aws.StringValue(from.Memory), aws.StringValue(to.Memory))
+	d.compare("networkMode", aws.StringValue(from.NetworkMode), aws.StringValue(to.NetworkMode))
+	d.compare("taskRoleArn", aws.StringValue(from.TaskRoleArn), aws.StringValue(to.TaskRoleArn))
+	d.compare("executionRoleArn", aws.StringValue(from.ExecutionRoleArn), aws.StringValue(to.ExecutionRoleArn))
+	d.compareMaps("volumes", volumesMap(from.Volumes), volumesMap(to.Volumes))
+
+	fromContainers := containersMap(from.ContainerDefinitions)
+	toContainers := containersMap(to.ContainerDefinitions)
+	for _, name := range containerNames(from.ContainerDefinitions, to.ContainerDefinitions) {
+		prefix := "containers[" + name + "]"
+		fc, fok := fromContainers[name]
+		tc, tok := toContainers[name]
+		if !fok || !tok {
+			d.compare(prefix, containerSummary(fc), containerSummary(tc))
+			continue
+		}
+		d.compare(prefix+".image", aws.StringValue(fc.Image), aws.StringValue(tc.Image))
+		d.compare(prefix+".cpu", int64String(fc.Cpu), int64String(tc.Cpu))
+		d.compare(prefix+".memory", int64String(fc.Memory), int64String(tc.Memory))
+		d.compare(prefix+".memoryReservation", int64String(fc.MemoryReservation), int64String(tc.MemoryReservation))
+		d.compareMaps(prefix+".environment", environmentMap(fc.Environment), environmentMap(tc.Environment))
+		d.compareMaps(prefix+".secrets", secretsMap(fc.Secrets), secretsMap(tc.Secrets))
+		d.compare(prefix+".portMappings", portMappings(fc.PortMappings), portMappings(tc.PortMappings))
+		d.compare(prefix+".mountPoints", jsonString(fc.MountPoints), jsonString(tc.MountPoints))
+	}
+	return d.entries
+}
+
+// differ collects differences between values.
+type differ struct {
+	entries []DiffEntry
+}
+
+func (d *differ) compare(field, from, to string) {
+	if from != to {
+		d.entries = append(d.entries, DiffEntry{Field: field, From: from, To: to})
+	}
+}
+
+func (d *differ) compareMaps(field string, from, to map[string]string) {
+	for _, key := range sortedKeys(from, to) {
+		d.compare(field+"."+key, from[key], to[key])
+	}
+}
+
+// sortedKeys returns the union of keys of two maps, sorted.
+func sortedKeys(a, b map[string]string) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	keys := make([]string, 0, len(a)+len(b))
+	for _, m := range []map[string]string{a, b} {
+		for k := range m {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// containerNames returns names of containers in two task definitions, sorted.
+func containerNames(a, b []*ecs.ContainerDefinition) []string {
+	names := make(map[string]string, len(a)+len(b))
+	for _, c := range append(append([]*ecs.ContainerDefinition{}, a...), b...) {
+		names[aws.StringValue(c.Name)] = ""
+	}
+	return sortedKeys(names, nil)
+}
+
+func containersMap(containers []*ecs.ContainerDefinition) map[string]*ecs.ContainerDefinition {
+	m := make(map[string]*ecs.ContainerDefinition, len(containers))
+	for _, c := range containers {
+		m[aws.StringValue(c.Name)] = c
+	}
+	return m
+}
+
+func containerSummary(c *ecs.ContainerDefinition) string {
+	if c == nil {
+		return ""
+	}
+	return aws.StringValue(c.Image)
+}
+
+func environmentMap(env []*ecs.KeyValuePair) map[string]string {
+	m := make(map[string]string, len(env))
+	for _, kv := range env {
+		m[aws.StringValue(kv.Name)] = aws.StringValue(kv.Value)
+	}
+	return m
+}
+
+func secretsMap(secrets []*ecs.Secret) map[string]string {
+	m := make(map[string]string, len(secrets))
+	for _, s := range secrets {
+		m[aws.StringValue(s.Name)] = aws.StringValue(s.ValueFrom)
+	}
+	return m
+}
+
+func volumesMap(volumes []*ecs.Volume) map[string]string {
+	m := make(map[string]string, len(volumes))
+	for _, v := range volumes {
+		m[aws.StringValue(v.Name)] = jsonString(v)
+	}
+	return m
+}
+
+// portMappings returns port mappings as a sorted list of
+// containerPort:hostPort/protocol.
+func portMappings(mappings []*ecs.PortMapping) string {
+	ss := make([]string, 0, len(mappings))
+	for _, pm := range mappings {
+		protocol := aws.StringValue(pm.Protocol)
+		if protocol == "" {
+			protocol = ecs.TransportProtocolTcp
+		}
+		ss = append(ss, fmt.Sprintf("%s:%s/%s", int64String(pm.ContainerPort), int64String(pm.HostPort), protocol))
+	}
+	sort.Strings(ss)
+	return strings.Join(ss, ", ")
+}
+
+func int64String(n *int64) string {
+	if n == nil {
+		return ""
+	}
+	return strconv.FormatInt(*n, 10)
+}
+
+func jsonString(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil || string(b) == "null" || string(b) == "[]" {
+		return ""
+	}
+	return string(b)
+}
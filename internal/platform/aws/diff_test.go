@@ -0,0 +1,87 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package aws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func Test_compareTaskDefinitions(t *testing.T) {
+	from := &ecs.TaskDefinition{
+		Memory:      aws.String("512"),
+		TaskRoleArn: aws.String("arn:aws:iam::123456789012:role/app"),
+		ContainerDefinitions: []*ecs.ContainerDefinition{
+			{
+				Name:  aws.String("app"),
+				Image: aws.String("app:def"),
+				Environment: []*ecs.KeyValuePair{
+					{Name: aws.String("LOG_LEVEL"), Value: aws.String("debug")},
+					{Name: aws.String("PORT"), Value: aws.String("8080")},
+				},
+				PortMappings: []*ecs.PortMapping{
+					{ContainerPort: aws.Int64(8080), HostPort: aws.Int64(0)},
+				},
+			},
+			{
+				Name:  aws.String("envoy"),
+				Image: aws.String("envoy:v1"),
+			},
+		},
+	}
+	to := &ecs.TaskDefinition{
+		Memory:      aws.String("1024"),
+		TaskRoleArn: aws.String("arn:aws:iam::123456789012:role/app"),
+		ContainerDefinitions: []*ecs.ContainerDefinition{
+			{
+				Name:  aws.String("app"),
+				Image: aws.String("app:abc"),
+				Environment: []*ecs.KeyValuePair{
+					{Name: aws.String("PORT"), Value: aws.String("8080")},
+				},
+				Secrets: []*ecs.Secret{
+					{Name: aws.String("DB_PASSWORD"), ValueFrom: aws.String("arn:aws:ssm:us-east-1:123456789012:parameter/db")},
+				},
+				PortMappings: []*ecs.PortMapping{
+					{ContainerPort: aws.Int64(8080), HostPort: aws.Int64(0), Protocol: aws.String("tcp")},
+				},
+			},
+		},
+	}
+	want := []DiffEntry{
+		{Field: "memory", From: "512", To: "1024"},
+		{Field: "containers[app].image", From: "app:def", To: "app:abc"},
+		{Field: "containers[app].environment.LOG_LEVEL", From: "debug", To: ""},
+		{Field: "containers[app].secrets.DB_PASSWORD", From: "", To: "arn:aws:ssm:us-east-1:123456789012:parameter/db"},
+		{Field: "containers[envoy]", From: "envoy:v1", To: ""},
+	}
+	got := compareTaskDefinitions(from, to)
+	if len(got) != len(want) {
+		t.Fatalf("compareTaskDefinitions() = %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("compareTaskDefinitions()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
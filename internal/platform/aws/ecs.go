@@ -21,17 +21,26 @@
 package aws
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudtrail"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/sts"
 )
 
 const awsApisErrorFmt = "error on AWS request: %s"
@@ -40,102 +49,752 @@ const awsApisErrorFmt = "error on AWS request: %s"
 type ServiceInfo struct {
 	ARN     string
 	TaskARN string
+	// Image, if TaskARN is empty, is an image reference (tag, digest or
+	// substring) used to look up the task version to rollback to.
+	Image string
+	// Strategy tells how the previous version has been found, if TaskARN
+	// has been looked up by ServicePreviousVersion.
+	Strategy string
+}
+
+// How ServicePreviousVersion finds a version.
+const (
+	// FromHistory is a version taken from deployment history.
+	FromHistory = "deployment history"
+	// FromRevisions is a revision older than those in deployment history,
+	// used when history is not enough.
+	FromRevisions = "previous revision"
+)
+
+// ServiceChange records the task versions of a service before and after a
+// rollback.
+type ServiceChange struct {
+	ARN         string
+	FromTaskARN string
+	ToTaskARN   string
+	// RegisteredTaskARN is set when ToTaskARN was INACTIVE and a new task
+	// definition has been registered with its configuration.
+	RegisteredTaskARN string
+	// Compensation is set when the change restores a service to its
+	// original version after an atomic rollback failed.
+	Compensation bool
+	// Strategy tells how the previous version has been found, empty if the
+	// version has been given.
+	Strategy string
+	// Duration is the time spent changing the service, health check
+	// included.
+	Duration time.Duration
+}
+
+// ServiceFailure describes a change that failed, it may have been made
+// anyway if the service failed its health check.
+type ServiceFailure struct {
+	ServiceChange
+	Err error
+}
+
+// RollbackError is returned when a rollback fails on some services.
+type RollbackError struct {
+	// Failures lists services that failed to be changed or restored.
+	Failures []ServiceFailure
+	Err      error
+}
+
+func (e *RollbackError) Error() string {
+	return e.Err.Error()
+}
+
+// CurrentTaskARN returns the task version the service runs after the change.
+func (sc ServiceChange) CurrentTaskARN() string {
+	if sc.RegisteredTaskARN != "" {
+		return sc.RegisteredTaskARN
+	}
+	return sc.ToTaskARN
+}
+
+// PlannedChange describes the change a rollback would make to a service.
+type PlannedChange struct {
+	ARN         string
+	FromTaskARN string
+	ToTaskARN   string
+	// Register is true when ToTaskARN is INACTIVE and a new task definition
+	// would be registered with its configuration.
+	Register bool
+}
+
+// ServiceState describes the rollout of the primary deployment of a service.
+type ServiceState struct {
+	ARN                string
+	RolloutState       string
+	RolloutStateReason string
+	Running            int64
+	Desired            int64
+	// TaskARN is the task definition of the primary deployment.
+	TaskARN string
+	// Deployments is the number of deployments of the service, primary
+	// included.
+	Deployments int
+}
+
+// Stable reports whether the primary deployment has completed and all its
+// desired tasks are running.
+func (ss ServiceState) Stable() bool {
+	if ss.Running != ss.Desired {
+		return false
+	}
+	if ss.RolloutState == "" {
+		// Rollout state is not reported for every deployment type, the
+		// primary deployment is considered done when no other is left.
+		return ss.Deployments == 1
+	}
+	return ss.RolloutState == ecs.DeploymentRolloutStateCompleted
+}
+
+// Failed reports whether the primary deployment has failed, e.g. because
+// the deployment circuit breaker tripped.
+func (ss ServiceState) Failed() bool {
+	return ss.RolloutState == ecs.DeploymentRolloutStateFailed
+}
+
+// InProgress reports whether a deployment is rolling out, e.g. one started
+// by CI, or older deployments are still running tasks. A failed primary
+// deployment is not in progress, it is what a rollback is for.
+func (ss ServiceState) InProgress() bool {
+	if ss.Failed() {
+		return false
+	}
+	return ss.Deployments > 1 || ss.RolloutState == ecs.DeploymentRolloutStateInProgress
+}
+
+// TaskVersion describes a revision of a task definition.
+type TaskVersion struct {
+	ARN          string
+	Status       string
+	RegisteredAt time.Time
+	Images       []string
+	CPU          string
+	Memory       string
+	// Current is true for the revision the service is running.
+	Current bool
+}
+
+// RollbackOptions tunes how ClusterRollback chooses versions for services.
+type RollbackOptions struct {
+	// Images maps service names to an image reference identifying the
+	// version to rollback to. Other services go to their previous version.
+	Images map[string]string
+	// Steps is the number of versions to go back, it defaults to one.
+	Steps int
+	// Filter selects services in the cluster to rollback.
+	Filter ServiceFilter
+	// HealthTimeout, if not zero, is the time to wait for the targets of
+	// rolled back services to be healthy in their load balancers.
+	HealthTimeout time.Duration
+	// Groups orders services in waves, one or more for each group,
+	// services not in any group are changed last.
+	Groups []ServiceGroup
+	// BatchSize, if positive, is the maximum number of services changed
+	// at the same time.
+	BatchSize int
+	// WaveDelay is the time to wait between waves.
+	WaveDelay time.Duration
+	// DependsOn maps service names to the services they depend on.
+	// Services are changed after their dependencies are stable.
+	DependsOn map[string][]string
+	// WaitWaves makes every wave wait for services of the previous one to
+	// be stable.
+	WaitWaves bool
+	// WaitStable, if not nil, waits until changed services are stable. It
+	// is used between waves, rollback stops if it returns an error.
+	WaitStable func(changes []ServiceChange) error
+	// Atomic restores changed services to their original versions if
+	// rollback fails on any service or, with WaitWaves, if any service is
+	// not stable at the end.
+	Atomic bool
+	// Force changes services even if they have a deployment in progress.
+	Force bool
+	// Proceed, if not nil, is called before every service is changed, the
+	// service is not changed if it returns an error, e.g. because the lock
+	// of the cluster has been lost.
+	Proceed func() error
+	// WaitDeployments, if not nil, waits for deployments in progress to
+	// settle before any service is changed. Otherwise services with a
+	// deployment in progress are refused, unless Force is set.
+	WaitDeployments func(serviceARNs []string) error
+	// Barriers lists task definitions, as family:revision, services cannot
+	// be rolled back past, in addition to those tagged ecsundo:barrier.
+	Barriers []string
+	// AllowBarrier lets services be rolled back past barriers.
+	AllowBarrier bool
+	// Redoing maps service names to the task versions ecsundo changed
+	// them to and that are being undone, their deployments in progress do
+	// not block the change.
+	Redoing map[string]string
+}
+
+// ServiceGroup is a named group of services, selected by name patterns as
+// in ServiceFilter includes.
+type ServiceGroup struct {
+	Name     string
+	Services []string
+}
+
+// ServiceFilter selects services by name and tags. Name patterns are globs
+// or, if enclosed in slashes, regular expressions.
+type ServiceFilter struct {
+	// Include, if not empty, selects only services matching a pattern.
+	Include []string
+	// Exclude skips services matching a pattern.
+	Exclude []string
+	// Tags selects only services having all these tags.
+	Tags map[string]string
 }
 
 // ECSService implements cli.ecsProvider.
 type ECSService struct {
 	verbose bool
-	client  *ecs.ECS
+	// concurrency is the maximum number of services worked on at the
+	// same time.
+	concurrency int
+	client      *ecs.ECS
+	elb         *elbv2.ELBV2
+	db          *dynamodb.DynamoDB
+	sts         *sts.STS
+	trail       *cloudtrail.CloudTrail
+	// trails caches deployment history of clusters from CloudTrail.
+	trails   map[string]*clusterTrail
+	trailsMu sync.Mutex
+}
+
+// ServicePreviousVersion returns as ARN string the task version deployed
+// steps versions before the current one, and how it has been found, as
+// FromHistory or FromRevisions. Versions are taken from service
+// deployment history, active deployments and those recorded by CloudTrail,
+// read only as far back as needed, when available, otherwise revisions
+// before the current one are used. Versions having the same configuration
+// of a more recent one are skipped.
+func (es *ECSService) ServicePreviousVersion(serviceName, clusterName string, steps int) (string, string, error) {
+	if steps < 1 {
+		return "", "", fmt.Errorf("invalid number of steps: %d", steps)
+	}
+	service, err := es.describeService(serviceName, clusterName)
+	if err != nil {
+		return "", "", fmt.Errorf(awsApisErrorFmt, err)
+	}
+	currentARN := *service.TaskDefinition
+	current, err := es.describeTaskDefinition(currentARN)
+	if err != nil {
+		return "", "", fmt.Errorf(awsApisErrorFmt, err)
+	}
+	family, _, err := parseTaskDefinition(currentARN)
+	if err != nil {
+		return "", "", err
+	}
+	taskDefs := make(map[string]*ecs.TaskDefinition)
+	deployments, since := es.serviceDeployments(service, func(deployments []deployment, since time.Time) bool {
+		walk, err := es.walkHistory(deploymentHistory(deployments, currentARN), current, steps, taskDefs)
+		// History must go back to when the current version has been
+		// registered, to know when it has been first deployed.
+		return err != nil || walk.TaskARN != "" && !since.After(aws.TimeValue(current.RegisteredAt))
+	})
+	walk, err := es.walkHistory(deploymentHistory(deployments, currentARN), current, steps, taskDefs)
+	if err != nil {
+		return "", "", err
+	}
+	if walk.TaskARN != "" {
+		return walk.TaskARN, FromHistory, nil
+	}
+	steps, lowest, seen := walk.Steps, walk.Lowest, walk.Seen
+	// Deployment history ran out, go on with revisions older than those
+	// in history.
+	taskARNs, err := es.familyRevisions(family, ecs.TaskDefinitionStatusActive, ecs.TaskDefinitionStatusInactive)
+	if err != nil {
+		return "", "", fmt.Errorf(awsApisErrorFmt, err)
+	}
+	for _, taskARN := range taskARNs {
+		if _, revision, err := parseTaskDefinition(taskARN); err != nil || revision >= lowest {
+			continue
+		}
+		taskDef, err := es.describeTaskDefinition(taskARN)
+		if err != nil {
+			return "", "", fmt.Errorf(awsApisErrorFmt, err)
+		}
+		if !since.IsZero() && aws.TimeValue(taskDef.RegisteredAt).After(since) {
+			// Registered while history is complete but missing from
+			// it, it has never been deployed on the service.
+			continue
+		}
+		fingerprint := taskFingerprint(taskDef)
+		if seen[fingerprint] {
+			continue
+		}
+		seen[fingerprint] = true
+		if steps--; steps == 0 {
+			return taskARN, FromRevisions, nil
+		}
+	}
+	return "", "", fmt.Errorf("impossible to rollback, %d more versions needed", steps)
 }
 
-// ServicePreviousVersion returns previous task version as ARN string.
-func (es *ECSService) ServicePreviousVersion(serviceName, clusterName string) (string, error) {
-	taskARN, err := es.getCurrentTask(serviceName, clusterName)
+// historyWalk is where looking for a previous version in deployment history
+// got to.
+type historyWalk struct {
+	// TaskARN is the version found, empty if history is not enough.
+	TaskARN string
+	// Steps is the number of versions still to go back.
+	Steps int
+	// Lowest is the lowest revision of the family found in history.
+	Lowest int
+	// Seen holds fingerprints of the versions gone through.
+	Seen map[string]bool
+}
+
+// walkHistory goes back steps versions in deployment history from the
+// current task definition, skipping versions having the same configuration
+// of a more recent one. Task definitions are described once, taskDefs
+// caches them between walks.
+func (es *ECSService) walkHistory(history []string, current *ecs.TaskDefinition, steps int, taskDefs map[string]*ecs.TaskDefinition) (historyWalk, error) {
+	family, lowest, err := parseTaskDefinition(aws.StringValue(current.TaskDefinitionArn))
+	if err != nil {
+		return historyWalk{}, err
+	}
+	walk := historyWalk{
+		Steps:  steps,
+		Lowest: lowest,
+		Seen:   map[string]bool{taskFingerprint(current): true},
+	}
+	for _, taskARN := range history {
+		taskDef, ok := taskDefs[taskARN]
+		if !ok {
+			taskDef, err = es.describeTaskDefinition(taskARN)
+			if isMissingTaskDefinition(err) {
+				taskDef, err = nil, nil
+			}
+			if err != nil {
+				return walk, fmt.Errorf(awsApisErrorFmt, err)
+			}
+			taskDefs[taskARN] = taskDef
+		}
+		if taskDef == nil {
+			// Revision has been deleted.
+			continue
+		}
+		if f, revision, err := parseTaskDefinition(taskARN); err == nil && f == family && revision < walk.Lowest {
+			walk.Lowest = revision
+		}
+		fingerprint := taskFingerprint(taskDef)
+		if walk.Seen[fingerprint] {
+			continue
+		}
+		walk.Seen[fingerprint] = true
+		if walk.Steps--; walk.Steps == 0 {
+			walk.TaskARN = taskARN
+			return walk, nil
+		}
+	}
+	return walk, nil
+}
+
+// ServiceVersion returns the ARN of a task version given as a revision number,
+// family:revision or full ARN. It checks that the task definition exists and
+// that it belongs to the same family of the one the service is running.
+func (es *ECSService) ServiceVersion(serviceName, clusterName, taskDefinition string) (string, error) {
+	currentARN, err := es.getCurrentTask(serviceName, clusterName)
+	if err != nil {
+		return "", fmt.Errorf(awsApisErrorFmt, err)
+	}
+	family, _, err := parseTaskDefinition(currentARN)
+	if err != nil {
+		return "", err
+	}
+	if _, err := strconv.Atoi(taskDefinition); err == nil {
+		taskDefinition = family + ":" + taskDefinition
+	}
+	taskDef, err := es.describeTaskDefinition(taskDefinition)
+	if err != nil {
+		return "", fmt.Errorf("task definition %q not found: %s", taskDefinition, err)
+	}
+	if *taskDef.Family != family {
+		return "", fmt.Errorf(
+			"task definition %q belongs to family %q, service runs %q",
+			taskDefinition, *taskDef.Family, family,
+		)
+	}
+	return *taskDef.TaskDefinitionArn, nil
+}
+
+// ServiceImageVersion returns the most recent task version of the service
+// family, other than the current one, having a container image whose tag or
+// digest is imageRef or, if there is none, contains it.
+func (es *ECSService) ServiceImageVersion(serviceName, clusterName, imageRef string) (string, error) {
+	currentARN, err := es.getCurrentTask(serviceName, clusterName)
 	if err != nil {
 		return "", fmt.Errorf(awsApisErrorFmt, err)
 	}
-	tt := strings.Split(taskARN, ":")
-	currentVersionStr := tt[len(tt)-1]
-	currentVersion, err := strconv.Atoi(currentVersionStr)
+	family, _, err := parseTaskDefinition(currentARN)
 	if err != nil {
 		return "", err
 	}
-	previousVersion := currentVersion - 1
-	if previousVersion <= 0 {
-		return "", fmt.Errorf("impossible to rollback to version %d", previousVersion)
+	taskARNs, err := es.familyRevisions(family, ecs.TaskDefinitionStatusActive, ecs.TaskDefinitionStatusInactive)
+	if err != nil {
+		return "", fmt.Errorf(awsApisErrorFmt, err)
+	}
+	partialARN := ""
+	for _, taskARN := range taskARNs {
+		if taskARN == currentARN {
+			continue
+		}
+		taskDef, err := es.describeTaskDefinition(taskARN)
+		if err != nil {
+			return "", fmt.Errorf(awsApisErrorFmt, err)
+		}
+		for _, container := range taskDef.ContainerDefinitions {
+			switch imageMatch(aws.StringValue(container.Image), imageRef) {
+			case exactMatch:
+				return taskARN, nil
+			case partialMatch:
+				if partialARN == "" {
+					partialARN = taskARN
+				}
+			}
+		}
+	}
+	if partialARN != "" {
+		return partialARN, nil
 	}
-	previousVersionStr := strconv.Itoa(previousVersion)
-	return strings.Join(append(tt[:len(tt)-1], previousVersionStr), ":"), nil
+	return "", fmt.Errorf("no task version of %q runs an image matching %q", family, imageRef)
+}
+
+// ServiceHistory returns the most recent revisions, at most limit if greater
+// than zero, of the task family the service runs, and the revision it runs if
+// older. Newest revision comes first.
+func (es *ECSService) ServiceHistory(serviceName, clusterName string, limit int) ([]TaskVersion, error) {
+	currentARN, err := es.getCurrentTask(serviceName, clusterName)
+	if err != nil {
+		return nil, fmt.Errorf(awsApisErrorFmt, err)
+	}
+	family, _, err := parseTaskDefinition(currentARN)
+	if err != nil {
+		return nil, err
+	}
+	taskARNs, err := es.familyRevisions(
+		family,
+		ecs.TaskDefinitionStatusActive,
+		ecs.TaskDefinitionStatusInactive,
+		ecs.TaskDefinitionStatusDeleteInProgress,
+	)
+	if err != nil {
+		return nil, fmt.Errorf(awsApisErrorFmt, err)
+	}
+	if limit > 0 && len(taskARNs) > limit {
+		older := taskARNs[limit:]
+		taskARNs = taskARNs[:limit:limit]
+		// The revision the service runs, e.g. after a rollback, is listed
+		// even if older.
+		for _, taskARN := range older {
+			if taskARN == currentARN {
+				taskARNs = append(taskARNs, taskARN)
+			}
+		}
+	}
+	versions := make([]TaskVersion, 0, len(taskARNs))
+	for _, taskARN := range taskARNs {
+		taskDef, err := es.describeTaskDefinition(taskARN)
+		if err != nil {
+			return nil, fmt.Errorf(awsApisErrorFmt, err)
+		}
+		images := make([]string, 0, len(taskDef.ContainerDefinitions))
+		for _, container := range taskDef.ContainerDefinitions {
+			images = append(images, aws.StringValue(container.Image))
+		}
+		versions = append(versions, TaskVersion{
+			ARN:          taskARN,
+			Status:       aws.StringValue(taskDef.Status),
+			RegisteredAt: aws.TimeValue(taskDef.RegisteredAt),
+			Images:       images,
+			CPU:          aws.StringValue(taskDef.Cpu),
+			Memory:       aws.StringValue(taskDef.Memory),
+			Current:      taskARN == currentARN,
+		})
+	}
+	return versions, nil
 }
 
 // ServiceRollback updates a service to use a specific task version. If task is
-// INACTIVE a new one is created with the old configuration.
-func (es *ECSService) ServiceRollback(serviceName, clusterName, taskARN string) error {
+// INACTIVE a new one is created with the old configuration. On error the
+// change is returned as far as it is known.
+func (es *ECSService) ServiceRollback(serviceName, clusterName, taskARN string) (ServiceChange, error) {
+	change := ServiceChange{ARN: serviceName, ToTaskARN: taskARN}
+	currentARN, err := es.getCurrentTask(serviceName, clusterName)
+	if err != nil {
+		return change, fmt.Errorf(awsApisErrorFmt, err)
+	}
+	change.FromTaskARN = currentARN
 	updateInput := &ecs.UpdateServiceInput{
 		Cluster:        aws.String(clusterName),
 		Service:        aws.String(serviceName),
 		TaskDefinition: aws.String(taskARN),
 	}
-	_, err := es.client.UpdateService(updateInput)
+	_, err = es.client.UpdateService(updateInput)
 	switch e := err.(type) {
 	case nil:
-		return nil
+		return change, nil
 	case awserr.Error:
 		if e.Message() != "TaskDefinition is inactive" {
-			return e
+			return change, e
 		}
 	default:
-		return fmt.Errorf(awsApisErrorFmt, err)
+		return change, fmt.Errorf(awsApisErrorFmt, err)
 	}
 	// At this point task is INACTIVE, register a new one with the same
 	// configuration and update service with this.
-	describeInput := &ecs.DescribeTaskDefinitionInput{
-		TaskDefinition: aws.String(taskARN),
+	taskDef, err := es.describeTaskDefinition(taskARN)
+	if err != nil {
+		return change, fmt.Errorf(awsApisErrorFmt, err)
 	}
-	out, err := es.client.DescribeTaskDefinition(describeInput)
+	registeredARN, err := es.registerAndUpdate(updateInput, registerInputFrom(taskDef), taskARN)
 	if err != nil {
-		return fmt.Errorf(awsApisErrorFmt, err)
+		return change, err
+	}
+	change.RegisteredTaskARN = registeredARN
+	return change, nil
+}
+
+// ServiceContainerRollback registers a new task definition from the one the
+// service runs, with the image of a single container, and optionally its
+// environment, taken from the given task version. Service is updated to use it.
+func (es *ECSService) ServiceContainerRollback(serviceName, clusterName, taskARN, containerName string, withEnv bool) (ServiceChange, error) {
+	currentARN, err := es.getCurrentTask(serviceName, clusterName)
+	if err != nil {
+		return ServiceChange{}, fmt.Errorf(awsApisErrorFmt, err)
+	}
+	current, err := es.describeTaskDefinition(currentARN)
+	if err != nil {
+		return ServiceChange{}, fmt.Errorf(awsApisErrorFmt, err)
+	}
+	source, err := es.describeTaskDefinition(taskARN)
+	if err != nil {
+		return ServiceChange{}, fmt.Errorf(awsApisErrorFmt, err)
+	}
+	registerInput, err := withContainerFrom(current, source, containerName, withEnv)
+	if err != nil {
+		return ServiceChange{}, err
 	}
-	taskDef := out.TaskDefinition
-	registerInput := &ecs.RegisterTaskDefinitionInput{
-		ContainerDefinitions:    taskDef.ContainerDefinitions,
-		Cpu:                     taskDef.Cpu,
-		ExecutionRoleArn:        taskDef.ExecutionRoleArn,
-		Family:                  taskDef.Family,
-		Memory:                  taskDef.Memory,
-		NetworkMode:             taskDef.NetworkMode,
-		PlacementConstraints:    taskDef.PlacementConstraints,
-		RequiresCompatibilities: taskDef.RequiresCompatibilities,
-		TaskRoleArn:             taskDef.TaskRoleArn,
-		Volumes:                 taskDef.Volumes,
+	updateInput := &ecs.UpdateServiceInput{
+		Cluster: aws.String(clusterName),
+		Service: aws.String(serviceName),
+	}
+	registeredARN, err := es.registerAndUpdate(updateInput, registerInput, taskARN)
+	if err != nil {
+		return ServiceChange{}, err
 	}
+	return ServiceChange{
+		ARN:               serviceName,
+		FromTaskARN:       currentARN,
+		ToTaskARN:         taskARN,
+		RegisteredTaskARN: registeredARN,
+	}, nil
+}
+
+// registerAndUpdate registers a new task definition and updates the service
+// to use it. It returns the ARN of the new task definition.
+func (es *ECSService) registerAndUpdate(updateInput *ecs.UpdateServiceInput, registerInput *ecs.RegisterTaskDefinitionInput, sourceARN string) (string, error) {
 	registerOut, err := es.client.RegisterTaskDefinition(registerInput)
 	if err != nil {
-		return fmt.Errorf(awsApisErrorFmt, err)
+		return "", fmt.Errorf(awsApisErrorFmt, err)
 	}
+	registeredARN := *registerOut.TaskDefinition.TaskDefinitionArn
 	if es.verbose {
-		fmt.Printf("%q new task definition registered with configuration from %q\n", *registerOut.TaskDefinition.TaskDefinitionArn, taskARN)
+		fmt.Printf("%q new task definition registered with configuration from %q\n", registeredARN, sourceARN)
 	}
-	updateInput.TaskDefinition = registerOut.TaskDefinition.TaskDefinitionArn
+	updateInput.TaskDefinition = aws.String(registeredARN)
 	_, err = es.client.UpdateService(updateInput)
 	if err != nil {
-		return fmt.Errorf(awsApisErrorFmt, err)
+		return "", fmt.Errorf(awsApisErrorFmt, err)
 	}
-	return nil
+	return registeredARN, nil
 }
 
 // ClusterRollback updates all services in an ECS cluster to their own previous
-// task definition.
-func (es *ECSService) ClusterRollback(clusterName string) error {
-	serviceARNptrs, err := es.listServices(clusterName)
+// task definition or to the one running the image given in options.
+func (es *ECSService) ClusterRollback(clusterName string, opts RollbackOptions) ([]ServiceChange, error) {
+	servicesInfo, err := es.clusterServices(clusterName, opts)
 	if err != nil {
-		return fmt.Errorf(awsApisErrorFmt, err)
+		return nil, err
 	}
-	servicesInfo := make([]ServiceInfo, 0, len(serviceARNptrs))
-	for _, serviceARNptr := range serviceARNptrs {
-		servicesInfo = append(servicesInfo, ServiceInfo{ARN: *serviceARNptr, TaskARN: ""})
+	return es.rollbackServices(servicesInfo, clusterName, opts)
+}
+
+// ServicesRollback updates services with the given names to their own
+// previous task definition or to the one running the image given in options.
+func (es *ECSService) ServicesRollback(serviceNames []string, clusterName string, opts RollbackOptions) ([]ServiceChange, error) {
+	servicesInfo := make([]ServiceInfo, 0, len(serviceNames))
+	for _, name := range serviceNames {
+		servicesInfo = append(servicesInfo, ServiceInfo{ARN: name, Image: opts.Images[name]})
 	}
-	return es.rollbackServices(servicesInfo, clusterName)
+	return es.rollbackServices(servicesInfo, clusterName, opts)
+}
+
+// PlanRollback returns the changes rolling back services would make, without
+// updating any service nor registering task definitions. Task versions are
+// resolved as for a real rollback.
+func (es *ECSService) PlanRollback(servicesInfo []ServiceInfo, clusterName string, opts RollbackOptions) ([]PlannedChange, error) {
+	servicesInfo, err := es.resolveVersions(servicesInfo, clusterName, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := es.CheckBarriers(servicesInfo, clusterName, opts); err != nil {
+		return nil, err
+	}
+	plan := make([]PlannedChange, 0, len(servicesInfo))
+	for _, service := range servicesInfo {
+		currentARN, err := es.getCurrentTask(service.ARN, clusterName)
+		if err != nil {
+			return nil, fmt.Errorf(awsApisErrorFmt, err)
+		}
+		taskDef, err := es.describeTaskDefinition(service.TaskARN)
+		if err != nil {
+			return nil, fmt.Errorf(awsApisErrorFmt, err)
+		}
+		plan = append(plan, PlannedChange{
+			ARN:         service.ARN,
+			FromTaskARN: currentARN,
+			ToTaskARN:   service.TaskARN,
+			Register:    aws.StringValue(taskDef.Status) == ecs.TaskDefinitionStatusInactive,
+		})
+	}
+	return plan, nil
+}
+
+// ServicesState returns the rollout state of services.
+func (es *ECSService) ServicesState(serviceNames []string, clusterName string) ([]ServiceState, error) {
+	states := make([]ServiceState, 0, len(serviceNames))
+	// DescribeServices accepts at most 10 services for each call.
+	for i := 0; i < len(serviceNames); i += 10 {
+		end := i + 10
+		if end > len(serviceNames) {
+			end = len(serviceNames)
+		}
+		input := &ecs.DescribeServicesInput{
+			Cluster:  aws.String(clusterName),
+			Services: aws.StringSlice(serviceNames[i:end]),
+		}
+		result, err := es.client.DescribeServices(input)
+		if err != nil {
+			return nil, fmt.Errorf(awsApisErrorFmt, err)
+		}
+		if len(result.Failures) > 0 {
+			failure := result.Failures[0]
+			return nil, fmt.Errorf("%s: %s", aws.StringValue(failure.Arn), aws.StringValue(failure.Reason))
+		}
+		for _, service := range result.Services {
+			states = append(states, serviceState(service))
+		}
+	}
+	return states, nil
+}
+
+// CheckDeployments returns an error if any service has a deployment in
+// progress, as changing it would give unpredictable results. If options set
+// WaitDeployments it waits for deployments to settle instead, nothing is
+// checked if options set Force.
+func (es *ECSService) CheckDeployments(serviceNames []string, clusterName string, opts RollbackOptions) error {
+	if opts.Force || len(serviceNames) == 0 {
+		return nil
+	}
+	states, err := es.ServicesState(serviceNames, clusterName)
+	if err != nil {
+		return err
+	}
+	busyARNs := make([]string, 0, len(states))
+	report := make([]string, 0, len(states))
+	for _, state := range states {
+		if !state.InProgress() {
+			continue
+		}
+		if taskARN, ok := opts.Redoing[ServiceName(state.ARN)]; ok && taskARN == state.TaskARN {
+			continue
+		}
+		busyARNs = append(busyARNs, state.ARN)
+		report = append(report, deploymentReport(state))
+	}
+	if len(busyARNs) == 0 {
+		return nil
+	}
+	if opts.WaitDeployments != nil {
+		if es.verbose {
+			fmt.Printf("waiting for deployments in progress:\n%s\n", strings.Join(report, "\n"))
+		}
+		if err := opts.WaitDeployments(busyARNs); err != nil {
+			return fmt.Errorf("no service changed, deployments in progress did not settle:\n%s", err)
+		}
+		return nil
+	}
+	return fmt.Errorf(
+		"no service changed, these services have a deployment in progress:\n%s",
+		strings.Join(report, "\n"),
+	)
+}
+
+// ClusterTargets returns the task versions ClusterRollback would update
+// services to.
+func (es *ECSService) ClusterTargets(clusterName string, opts RollbackOptions) ([]ServiceInfo, error) {
+	if _, err := dependencyLevels(nil, opts.DependsOn); err != nil {
+		return nil, err
+	}
+	if err := es.checkDependencies(clusterName, opts.DependsOn); err != nil {
+		return nil, err
+	}
+	servicesInfo, err := es.clusterServices(clusterName, opts)
+	if err != nil {
+		return nil, err
+	}
+	return es.resolveVersions(servicesInfo, clusterName, opts)
+}
+
+// ClusterStateAt returns the task versions services in a cluster selected by
+// filter were running at a given time, found from their deployment history,
+// for services running a different version now. It also returns services
+// whose history does not go back to that time, they are left out.
+func (es *ECSService) ClusterStateAt(clusterName string, at time.Time, filter ServiceFilter) ([]ServiceInfo, []string, error) {
+	services, err := es.clusterServices(clusterName, RollbackOptions{Filter: filter})
+	if err != nil {
+		return nil, nil, err
+	}
+	results := make([]ServiceInfo, len(services))
+	unknown := make([]bool, len(services))
+	errs := make([]error, len(services))
+	es.forEach(len(services), func(i int) {
+		service, err := es.describeService(services[i].ARN, clusterName)
+		if err != nil {
+			errs[i] = fmt.Errorf(awsApisErrorFmt, err)
+			return
+		}
+		deployments, _ := es.serviceDeployments(service, func(deployments []deployment, _ time.Time) bool {
+			return deploymentAt(deployments, at) != ""
+		})
+		taskARN := deploymentAt(deployments, at)
+		switch {
+		case taskARN == "":
+			unknown[i] = true
+		case taskARN != *service.TaskDefinition:
+			results[i] = ServiceInfo{ARN: services[i].ARN, TaskARN: taskARN}
+		}
+	})
+	servicesInfo := make([]ServiceInfo, 0, len(services))
+	skipped := make([]string, 0)
+	for i, result := range results {
+		if errs[i] != nil {
+			return nil, nil, errs[i]
+		}
+		if unknown[i] {
+			skipped = append(skipped, services[i].ARN)
+		}
+		if result.ARN != "" {
+			servicesInfo = append(servicesInfo, result)
+		}
+	}
+	return servicesInfo, skipped, nil
 }
 
 // ClusterSnapshot returns current task versions for all services.
@@ -144,38 +803,108 @@ func (es *ECSService) ClusterSnapshot(clusterName string) ([]ServiceInfo, error)
 	if err != nil {
 		return nil, fmt.Errorf(awsApisErrorFmt, err)
 	}
-	errCh := make(chan error)
-	resultsCh := make(chan ServiceInfo)
+	servicesInfo := make([]ServiceInfo, len(serviceARNptrs))
+	errs := make([]error, len(serviceARNptrs))
+	es.forEach(len(serviceARNptrs), func(i int) {
+		serviceARN := *serviceARNptrs[i]
+		taskARN, err := es.getCurrentTask(serviceARN, clusterName)
+		if err != nil {
+			errs[i] = fmt.Errorf("%q: %s", nameFromARN(serviceARN), err)
+			return
+		}
+		servicesInfo[i] = ServiceInfo{ARN: serviceARN, TaskARN: taskARN}
+	})
+	for _, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf(awsApisErrorFmt, err)
+		}
+	}
+	return servicesInfo, nil
+}
+
+// ClusterRestore restores all services to specific versions.
+func (es *ECSService) ClusterRestore(serviceSnapshots []ServiceInfo, clusterName string, opts RollbackOptions) ([]ServiceChange, error) {
+	return es.rollbackServices(serviceSnapshots, clusterName, opts)
+}
+
+// clusterServices returns services in a cluster with the image to look for
+// set from options.
+func (es *ECSService) clusterServices(clusterName string, opts RollbackOptions) ([]ServiceInfo, error) {
+	serviceARNptrs, err := es.listServices(clusterName)
+	if err != nil {
+		return nil, fmt.Errorf(awsApisErrorFmt, err)
+	}
+	servicesInfo := make([]ServiceInfo, 0, len(serviceARNptrs))
 	for _, serviceARNptr := range serviceARNptrs {
-		go func(serviceARN string) {
-			client := NewECSClient(es.verbose)
-			taskARN, err := client.getCurrentTask(serviceARN, clusterName)
+		servicesInfo = append(servicesInfo, ServiceInfo{ARN: *serviceARNptr})
+	}
+	servicesInfo, err = es.FilterServices(servicesInfo, clusterName, opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]bool, len(opts.Images))
+	for i := range servicesInfo {
+		name := ServiceName(servicesInfo[i].ARN)
+		image, ok := opts.Images[name]
+		found[name] = ok
+		servicesInfo[i].Image = image
+	}
+	for name := range opts.Images {
+		if !found[name] {
+			return nil, fmt.Errorf("service %q not found in cluster or excluded by filter", name)
+		}
+	}
+	return servicesInfo, nil
+}
+
+// FilterServices returns services selected by filter.
+func (es *ECSService) FilterServices(servicesInfo []ServiceInfo, clusterName string, filter ServiceFilter) ([]ServiceInfo, error) {
+	filtered := make([]ServiceInfo, 0, len(servicesInfo))
+	for _, serviceInfo := range servicesInfo {
+		ok, err := filter.matchName(ServiceName(serviceInfo.ARN))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if len(filter.Tags) > 0 {
+			tagsOut, err := es.client.ListTagsForResource(&ecs.ListTagsForResourceInput{
+				ResourceArn: aws.String(serviceInfo.ARN),
+			})
 			if err != nil {
-				errCh <- fmt.Errorf("%q: %s", nameFromARN(serviceARN), err)
-				return
+				return nil, fmt.Errorf(awsApisErrorFmt, err)
+			}
+			if !hasTags(tagsOut.Tags, filter.Tags) {
+				continue
 			}
-			resultsCh <- ServiceInfo{ARN: serviceARN, TaskARN: taskARN}
-		}(*serviceARNptr)
-	}
-	l := len(serviceARNptrs)
-	servicesInfo := make([]ServiceInfo, 0, l)
-	var lastErr error
-	for i := 0; i < l; i++ {
-		select {
-		case result := <-resultsCh:
-			servicesInfo = append(servicesInfo, result)
-		case lastErr = <-errCh:
 		}
+		filtered = append(filtered, serviceInfo)
 	}
-	if lastErr != nil {
-		return nil, fmt.Errorf(awsApisErrorFmt, lastErr)
+	if es.verbose {
+		fmt.Printf("%d of %d services selected\n", len(filtered), len(servicesInfo))
 	}
-	return servicesInfo, nil
+	return filtered, nil
 }
 
-// ClusterRestore restores all services to specific versions.
-func (es *ECSService) ClusterRestore(serviceSnapshots []ServiceInfo, clusterName string) error {
-	return es.rollbackServices(serviceSnapshots, clusterName)
+// checkDependencies returns an error if dependencies name services that are
+// not in the cluster, they would be silently ignored otherwise.
+func (es *ECSService) checkDependencies(clusterName string, dependsOn map[string][]string) error {
+	if len(dependsOn) == 0 {
+		return nil
+	}
+	serviceARNptrs, err := es.listServices(clusterName)
+	if err != nil {
+		return fmt.Errorf(awsApisErrorFmt, err)
+	}
+	names := make([]string, 0, len(serviceARNptrs))
+	for _, serviceARNptr := range serviceARNptrs {
+		names = append(names, ServiceName(*serviceARNptr))
+	}
+	if unknown := unknownDependencies(names, dependsOn); len(unknown) > 0 {
+		return fmt.Errorf("dependsOn names services not in cluster %q: %s", clusterName, strings.Join(unknown, ", "))
+	}
+	return nil
 }
 
 func (es *ECSService) listServices(clusterName string) ([]*string, error) {
@@ -198,7 +927,47 @@ func (es *ECSService) listServices(clusterName string) ([]*string, error) {
 	return serviceARNs, nil
 }
 
-func (es *ECSService) getCurrentTask(serviceName, clusterName string) (string, error) {
+// familyRevisions returns ARNs of revisions of a task family having one of
+// the given statuses, newest first.
+func (es *ECSService) familyRevisions(family string, statuses ...string) ([]string, error) {
+	revisions := make(map[int]string)
+	for _, status := range statuses {
+		listInput := &ecs.ListTaskDefinitionsInput{
+			FamilyPrefix: aws.String(family),
+			Status:       aws.String(status),
+		}
+		for {
+			listOut, err := es.client.ListTaskDefinitions(listInput)
+			if err != nil {
+				return nil, err
+			}
+			for _, taskARNptr := range listOut.TaskDefinitionArns {
+				// FamilyPrefix also matches families sharing the same prefix.
+				f, revision, err := parseTaskDefinition(*taskARNptr)
+				if err != nil || f != family {
+					continue
+				}
+				revisions[revision] = *taskARNptr
+			}
+			if listOut.NextToken == nil {
+				break
+			}
+			listInput.NextToken = listOut.NextToken
+		}
+	}
+	numbers := make([]int, 0, len(revisions))
+	for n := range revisions {
+		numbers = append(numbers, n)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(numbers)))
+	taskARNs := make([]string, 0, len(numbers))
+	for _, n := range numbers {
+		taskARNs = append(taskARNs, revisions[n])
+	}
+	return taskARNs, nil
+}
+
+func (es *ECSService) describeService(serviceName, clusterName string) (*ecs.Service, error) {
 	input := &ecs.DescribeServicesInput{
 		Cluster: aws.String(clusterName),
 		Services: []*string{
@@ -206,73 +975,281 @@ func (es *ECSService) getCurrentTask(serviceName, clusterName string) (string, e
 		},
 	}
 	result, err := es.client.DescribeServices(input)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Services) == 0 || result.Services[0].TaskDefinition == nil {
+		return nil, fmt.Errorf("empty task definition for %s", serviceName)
+	}
+	return result.Services[0], nil
+}
+
+func (es *ECSService) describeTaskDefinition(taskDefinition string) (*ecs.TaskDefinition, error) {
+	describeInput := &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: aws.String(taskDefinition),
+	}
+	out, err := es.client.DescribeTaskDefinition(describeInput)
+	if err != nil {
+		return nil, err
+	}
+	return out.TaskDefinition, nil
+}
+
+func (es *ECSService) getCurrentTask(serviceName, clusterName string) (string, error) {
+	service, err := es.describeService(serviceName, clusterName)
 	if err != nil {
 		return "", err
 	}
-	var taskARNPtr *string
-	if len(result.Services) > 0 {
-		taskARNPtr = result.Services[0].TaskDefinition
+	return *service.TaskDefinition, nil
+}
+
+// resolveVersions fills the task version for services that do not specify
+// one, so that every version is known before any service is changed.
+func (es *ECSService) resolveVersions(servicesInfo []ServiceInfo, clusterName string, opts RollbackOptions) ([]ServiceInfo, error) {
+	steps := opts.Steps
+	if steps == 0 {
+		steps = 1
 	}
-	if taskARNPtr == nil {
-		return "", fmt.Errorf("empty task definition for %s", serviceName)
+	resolved := make([]ServiceInfo, len(servicesInfo))
+	failures := make([]string, len(servicesInfo))
+	es.forEach(len(servicesInfo), func(i int) {
+		service := servicesInfo[i]
+		if service.TaskARN == "" {
+			var err error
+			if service.Image != "" {
+				service.TaskARN, err = es.ServiceImageVersion(service.ARN, clusterName, service.Image)
+			} else {
+				service.TaskARN, service.Strategy, err = es.ServicePreviousVersion(service.ARN, clusterName, steps)
+			}
+			if err != nil {
+				failures[i] = fmt.Sprintf("%q: %s", ServiceName(service.ARN), err)
+				return
+			}
+		}
+		resolved[i] = service
+	})
+	failedServices := make([]string, 0, len(servicesInfo))
+	for _, failure := range failures {
+		if failure != "" {
+			failedServices = append(failedServices, failure)
+		}
+	}
+	if len(failedServices) > 0 {
+		return nil, fmt.Errorf(
+			"no service changed, unable to find version for these services:\n%s",
+			strings.Join(failedServices, "\n"),
+		)
 	}
-	return *taskARNPtr, nil
+	return resolved, nil
 }
 
 // rollbackServices rollbacks all services to the versions specified.
-// If the task version supplied is empty it will attempt to rollback to previous version.
-func (es *ECSService) rollbackServices(servicesInfo []ServiceInfo, clusterName string) error {
-	doneCh := make(chan struct{})
-	failedCh := make(chan string)
+// If the task version supplied is empty it will attempt to rollback to the
+// image or to the number of steps back given in options.
+// Services are changed in waves as set in options, the next wave starts only
+// if the previous one succeeded.
+// No service is changed if any has a deployment in progress or would cross
+// a barrier, unless options say otherwise.
+// Changes are returned also when rollback fails on some services, unless
+// rollback is atomic and changed services have been restored.
+func (es *ECSService) rollbackServices(servicesInfo []ServiceInfo, clusterName string, opts RollbackOptions) ([]ServiceChange, error) {
+	serviceARNs := make([]string, 0, len(servicesInfo))
 	for _, service := range servicesInfo {
-		go func(service ServiceInfo) {
-			defer func() {
-				doneCh <- struct{}{}
-			}()
-			sendError := func(err error) {
-				failedCh <- fmt.Sprintf("%q: %s", nameFromARN(service.ARN), err)
-			}
-			client := NewECSClient(es.verbose)
-			if service.TaskARN == "" {
-				taskARN, err := client.ServicePreviousVersion(service.ARN, clusterName)
-				if err != nil {
-					sendError(err)
-					return
-				}
-				service.TaskARN = taskARN
-			}
-			if es.verbose {
-				fmt.Printf("rolling back %q to %s\n", nameFromARN(service.ARN), nameFromARN(service.TaskARN))
+		serviceARNs = append(serviceARNs, service.ARN)
+	}
+	if err := es.CheckDeployments(serviceARNs, clusterName, opts); err != nil {
+		return nil, err
+	}
+	servicesInfo, err := es.resolveVersions(servicesInfo, clusterName, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := es.CheckBarriers(servicesInfo, clusterName, opts); err != nil {
+		return nil, err
+	}
+	levels, err := dependencyLevels(servicesInfo, opts.DependsOn)
+	if err != nil {
+		return nil, err
+	}
+	if err := es.checkDependencies(clusterName, opts.DependsOn); err != nil {
+		return nil, err
+	}
+	// All waves are planned first, to report errors before any change.
+	var waves [][]ServiceInfo
+	// levelEnds marks waves that complete a dependency level.
+	levelEnds := make(map[int]bool, len(levels))
+	for _, level := range levels {
+		levelWaves, err := splitWaves(level, opts.Groups, opts.BatchSize)
+		if err != nil {
+			return nil, err
+		}
+		waves = append(waves, levelWaves...)
+		levelEnds[len(waves)-1] = true
+	}
+	changes, failures, err := es.rollbackWaves(waves, levelEnds, clusterName, opts)
+	if err != nil && opts.Atomic && len(changes) > 0 {
+		var compensationFailures []ServiceFailure
+		changes, compensationFailures, err = es.compensate(changes, clusterName, err)
+		failures = append(failures, compensationFailures...)
+	}
+	if len(failures) > 0 {
+		return changes, &RollbackError{Failures: failures, Err: err}
+	}
+	return changes, err
+}
+
+// rollbackWaves changes services one wave after the other, waiting for them
+// to be stable as set in options. levelEnds marks waves that complete a
+// dependency level. It stops at the first failure, returning changes made
+// and services that failed.
+func (es *ECSService) rollbackWaves(waves [][]ServiceInfo, levelEnds map[int]bool, clusterName string, opts RollbackOptions) ([]ServiceChange, []ServiceFailure, error) {
+	changes := make([]ServiceChange, 0)
+	var levelChanges []ServiceChange
+	for i, wave := range waves {
+		if i > 0 && opts.WaveDelay > 0 {
+			time.Sleep(opts.WaveDelay)
+		}
+		if es.verbose && len(waves) > 1 {
+			fmt.Printf("starting wave %d of %d with %d services\n", i+1, len(waves), len(wave))
+		}
+		waveChanges, failures := es.rollbackWave(wave, clusterName, opts)
+		changes = append(changes, waveChanges...)
+		levelChanges = append(levelChanges, waveChanges...)
+		if len(failures) > 0 {
+			err := fmt.Errorf(
+				"rollback failed on these services:\n%s",
+				strings.Join(failureReport(failures), "\n"),
+			)
+			if i < len(waves)-1 {
+				err = fmt.Errorf("%s\nrollback stopped after wave %d of %d", err, i+1, len(waves))
 			}
-			err := client.ServiceRollback(service.ARN, clusterName, service.TaskARN)
-			if err != nil {
-				sendError(err)
+			return changes, failures, err
+		}
+		if i == len(waves)-1 || opts.WaitStable == nil {
+			continue
+		}
+		var toWait []ServiceChange
+		switch {
+		case levelEnds[i]:
+			// Dependents of this level wait for all of its services.
+			toWait = levelChanges
+			levelChanges = nil
+		case opts.WaitWaves:
+			toWait = waveChanges
+		default:
+			continue
+		}
+		if err := opts.WaitStable(toWait); err != nil {
+			return changes, nil, fmt.Errorf("%s\nrollback stopped after wave %d of %d", err, i+1, len(waves))
+		}
+	}
+	if opts.Atomic && opts.WaitWaves && opts.WaitStable != nil {
+		if err := opts.WaitStable(changes); err != nil {
+			return changes, nil, err
+		}
+	}
+	return changes, nil, nil
+}
+
+// compensate restores changed services to their original versions after an
+// atomic rollback failed with cause. It returns changes followed by those
+// made to restore them, services it was unable to restore and an error
+// reporting what has been compensated.
+func (es *ECSService) compensate(changes []ServiceChange, clusterName string, cause error) ([]ServiceChange, []ServiceFailure, error) {
+	originals := make([]ServiceInfo, 0, len(changes))
+	for _, change := range changes {
+		originals = append(originals, ServiceInfo{ARN: change.ARN, TaskARN: change.FromTaskARN})
+	}
+	if es.verbose {
+		fmt.Printf("atomic rollback failed, restoring %d changed services\n", len(originals))
+	}
+	restored, failures := es.rollbackWave(originals, clusterName, RollbackOptions{})
+	report := make([]string, 0, len(restored))
+	for i := range restored {
+		restored[i].Compensation = true
+		report = append(report, fmt.Sprintf("%q: %s", ServiceName(restored[i].ARN), nameFromARN(restored[i].CurrentTaskARN())))
+	}
+	for i := range failures {
+		failures[i].Compensation = true
+	}
+	sort.Strings(report)
+	msg := fmt.Sprintf("%s\natomic rollback, these services have been restored to their original versions:\n%s", cause, strings.Join(report, "\n"))
+	if len(failures) > 0 {
+		msg += fmt.Sprintf("\nunable to restore these services:\n%s", strings.Join(failureReport(failures), "\n"))
+	}
+	return append(changes, restored...), failures, errors.New(msg)
+}
+
+// rollbackWave rollbacks services concurrently. It returns changes made and
+// failures for services that could not be changed or failed their health
+// check.
+func (es *ECSService) rollbackWave(servicesInfo []ServiceInfo, clusterName string, opts RollbackOptions) ([]ServiceChange, []ServiceFailure) {
+	results := make([]ServiceChange, len(servicesInfo))
+	changed := make([]bool, len(servicesInfo))
+	errs := make([]error, len(servicesInfo))
+	es.forEach(len(servicesInfo), func(i int) {
+		service := servicesInfo[i]
+		if opts.Proceed != nil {
+			if err := opts.Proceed(); err != nil {
+				results[i] = ServiceChange{ARN: service.ARN, ToTaskARN: service.TaskARN, Strategy: service.Strategy}
+				errs[i] = err
 				return
 			}
-		}(service)
-	}
-	l := len(servicesInfo)
-	failedServiceARNs := make([]string, 0, l)
-	i := 0
-	for i < l {
-		select {
-		case <-doneCh:
-			i++
-		case serviceARN := <-failedCh:
-			failedServiceARNs = append(failedServiceARNs, serviceARN)
-		}
-	}
-	if len(failedServiceARNs) > 0 {
-		return fmt.Errorf(
-			"rollback failed on these services:\n%s",
-			strings.Join(failedServiceARNs, "\n"),
-		)
+		}
+		if es.verbose {
+			fmt.Printf("rolling back %q to %s\n", ServiceName(service.ARN), nameFromARN(service.TaskARN))
+		}
+		started := time.Now()
+		change, err := es.ServiceRollback(service.ARN, clusterName, service.TaskARN)
+		changed[i] = err == nil
+		if err == nil && opts.HealthTimeout > 0 {
+			err = es.WaitTargetsHealthy(service.ARN, clusterName, change.CurrentTaskARN(), opts.HealthTimeout)
+		}
+		change.Duration = time.Since(started)
+		change.Strategy = service.Strategy
+		results[i], errs[i] = change, err
+	})
+	changes := make([]ServiceChange, 0, len(servicesInfo))
+	failures := make([]ServiceFailure, 0, len(servicesInfo))
+	for i, change := range results {
+		// A service failing the health check has been changed anyway.
+		if changed[i] {
+			changes = append(changes, change)
+		}
+		if errs[i] != nil {
+			failures = append(failures, ServiceFailure{ServiceChange: change, Err: errs[i]})
+		}
 	}
-	return nil
+	return changes, failures
+}
+
+// failureReport describes failed services, one for every line.
+func failureReport(failures []ServiceFailure) []string {
+	report := make([]string, 0, len(failures))
+	for _, failure := range failures {
+		report = append(report, fmt.Sprintf("%q: %s", ServiceName(failure.ARN), failure.Err))
+	}
+	return report
+}
+
+// Region returns the AWS region the client operates in.
+func (es *ECSService) Region() string {
+	return aws.StringValue(es.client.Config.Region)
 }
 
-// NewECSClient returns an implementation of cmd.ecsService.
-func NewECSClient(verbose bool) *ECSService {
+// CallerIdentity returns the ARN of the AWS identity requests are made with.
+func (es *ECSService) CallerIdentity() (string, error) {
+	out, err := es.sts.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf(awsApisErrorFmt, err)
+	}
+	return aws.StringValue(out.Arn), nil
+}
+
+// NewECSClient returns an implementation of cmd.ecsService. Requests are
+// shared by at most concurrency workers, throttled and failed requests are
+// retried with backoff.
+func NewECSClient(verbose bool, concurrency int) *ECSService {
 	if os.Getenv("AWS_REGION") == "" {
 		region, err := getRegion()
 		if err != nil {
@@ -281,15 +1258,31 @@ func NewECSClient(verbose bool) *ECSService {
 			os.Setenv("AWS_REGION", region)
 		}
 	}
-	session := session.New(
+	config := request.WithRetryer(
 		&aws.Config{
 			HTTPClient: &http.Client{
 				Timeout: time.Second * 20,
 			},
 		},
+		&retryer{
+			DefaultRetryer: client.DefaultRetryer{
+				NumMaxRetries:    8,
+				MinRetryDelay:    100 * time.Millisecond,
+				MaxRetryDelay:    5 * time.Second,
+				MinThrottleDelay: 500 * time.Millisecond,
+				MaxThrottleDelay: 20 * time.Second,
+			},
+			verbose: verbose,
+		},
 	)
+	session := session.New(config)
 	return &ECSService{
-		verbose: verbose,
-		client:  ecs.New(session),
+		verbose:     verbose,
+		concurrency: concurrency,
+		client:      ecs.New(session),
+		elb:         elbv2.New(session),
+		db:          dynamodb.New(session),
+		sts:         sts.New(session),
+		trail:       cloudtrail.New(session),
 	}
 }
@@ -0,0 +1,324 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package aws
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// fakeECS serves ListServices, DescribeServices and UpdateService for
+// services running the task definitions in tasks, updates of services in
+// failing fail. Services are listed with ARNs in the long format. It also
+// serves DescribeTaskDefinition for task definitions registered at the
+// times in registered, all ACTIVE and running an image tagged with their
+// revision, and lists them.
+// Services in inProgress have a primary deployment rolling out.
+type fakeECS struct {
+	mu         sync.Mutex
+	tasks      map[string]string
+	failing    map[string]bool
+	registered map[string]time.Time
+	inProgress map[string]bool
+}
+
+func (f *fakeECS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	switch target := r.Header.Get("X-Amz-Target"); {
+	case strings.HasSuffix(target, ".ListServices"):
+		var input struct{ Cluster string }
+		json.NewDecoder(r.Body).Decode(&input)
+		serviceARNs := make([]string, 0, len(f.tasks))
+		for name := range f.tasks {
+			serviceARNs = append(serviceARNs, "arn:aws:ecs:us-east-1:123456789012:service/"+input.Cluster+"/"+name)
+		}
+		sort.Strings(serviceARNs)
+		json.NewEncoder(w).Encode(map[string]interface{}{"serviceArns": serviceARNs})
+	case strings.HasSuffix(target, ".DescribeServices"):
+		var input struct {
+			Cluster  string
+			Services []string
+		}
+		json.NewDecoder(r.Body).Decode(&input)
+		services := make([]map[string]interface{}, 0, len(input.Services))
+		for _, name := range input.Services {
+			serviceARN := name
+			if !strings.HasPrefix(name, "arn:") {
+				serviceARN = "arn:aws:ecs:us-east-1:123456789012:service/" + input.Cluster + "/" + name
+			}
+			rolloutState := ecs.DeploymentRolloutStateCompleted
+			if f.inProgress[name] {
+				rolloutState = ecs.DeploymentRolloutStateInProgress
+			}
+			services = append(services, map[string]interface{}{
+				"serviceArn":     serviceARN,
+				"serviceName":    ServiceName(name),
+				"clusterArn":     "arn:aws:ecs:us-east-1:123456789012:cluster/" + input.Cluster,
+				"taskDefinition": f.tasks[name],
+				"deployments": []map[string]interface{}{{
+					"status":         "PRIMARY",
+					"taskDefinition": f.tasks[name],
+					"rolloutState":   rolloutState,
+					"runningCount":   2,
+					"desiredCount":   2,
+				}},
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"services": services})
+	case strings.HasSuffix(target, ".ListTaskDefinitions"):
+		var input struct{ FamilyPrefix, Status string }
+		json.NewDecoder(r.Body).Decode(&input)
+		taskARNs := make([]string, 0, len(f.registered))
+		if input.Status == ecs.TaskDefinitionStatusActive {
+			for taskARN := range f.registered {
+				if family, _, err := parseTaskDefinition(taskARN); err == nil && family == input.FamilyPrefix {
+					taskARNs = append(taskARNs, taskARN)
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"taskDefinitionArns": taskARNs})
+	case strings.HasSuffix(target, ".DescribeTaskDefinition"):
+		var input struct{ TaskDefinition string }
+		json.NewDecoder(r.Body).Decode(&input)
+		registeredAt, ok := f.registered[input.TaskDefinition]
+		family, revision, err := parseTaskDefinition(input.TaskDefinition)
+		if !ok || err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "ClientException", "message": "The specified task definition does not exist."})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"taskDefinition": map[string]interface{}{
+			"taskDefinitionArn": input.TaskDefinition,
+			"family":            family,
+			"revision":          revision,
+			"status":            ecs.TaskDefinitionStatusActive,
+			"registeredAt":      float64(registeredAt.Unix()),
+			"containerDefinitions": []map[string]string{
+				{"name": family, "image": family + ":" + strconv.Itoa(revision)},
+			},
+		}})
+	case strings.HasSuffix(target, ".UpdateService"):
+		var input struct{ Service, TaskDefinition string }
+		json.NewDecoder(r.Body).Decode(&input)
+		if f.failing[input.Service] {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "ClientException", "message": "update refused"})
+			return
+		}
+		f.tasks[input.Service] = input.TaskDefinition
+		json.NewEncoder(w).Encode(map[string]interface{}{})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"__type": "ClientException", "message": "unexpected " + target})
+	}
+}
+
+// newFakeECSService returns an ECSService making requests to server.
+func newFakeECSService(server *httptest.Server) *ECSService {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+	return &ECSService{concurrency: 2, client: ecs.New(sess)}
+}
+
+func TestECSService_ClusterRestoreAtomic(t *testing.T) {
+	fake := &fakeECS{
+		tasks:   map[string]string{"api": "api:2", "worker": "worker:7"},
+		failing: map[string]bool{"worker": true},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	es := newFakeECSService(server)
+	opts := RollbackOptions{Atomic: true, Force: true, AllowBarrier: true}
+	changes, err := es.ClusterRestore([]ServiceInfo{
+		{ARN: "api", TaskARN: "api:1"},
+		{ARN: "worker", TaskARN: "worker:6"},
+	}, "my-cluster", opts)
+	if err == nil || !strings.Contains(err.Error(), "restored to their original versions") {
+		t.Fatal("expected compensation error, got:", err)
+	}
+	want := []ServiceChange{
+		{ARN: "api", FromTaskARN: "api:2", ToTaskARN: "api:1"},
+		{ARN: "api", FromTaskARN: "api:1", ToTaskARN: "api:2", Compensation: true},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("changes = %+v, want %+v", changes, want)
+	}
+	for i := range want {
+		if changes[i].Duration <= 0 {
+			t.Errorf("changes[%d]: duration not recorded", i)
+		}
+		changes[i].Duration = 0
+		if changes[i] != want[i] {
+			t.Errorf("changes[%d] = %+v, want %+v", i, changes[i], want[i])
+		}
+	}
+	rbErr, ok := err.(*RollbackError)
+	if !ok || len(rbErr.Failures) != 1 {
+		t.Fatalf("failures not reported: %#v", err)
+	}
+	if failure := rbErr.Failures[0]; failure.ARN != "worker" || failure.FromTaskARN != "worker:7" || failure.ToTaskARN != "worker:6" {
+		t.Errorf("wrong failure: %+v", failure)
+	}
+	if fake.tasks["api"] != "api:2" || fake.tasks["worker"] != "worker:7" {
+		t.Error("services not restored:", fake.tasks)
+	}
+}
+
+func TestECSService_FilterServices(t *testing.T) {
+	es := &ECSService{}
+	servicesInfo := testServices("api", "api-admin", "web", "datadog-agent")
+	tests := []struct {
+		filter ServiceFilter
+		want   [][]string
+	}{
+		{ServiceFilter{}, [][]string{{"api", "api-admin", "web", "datadog-agent"}}},
+		{ServiceFilter{Include: []string{"api"}}, [][]string{{"api"}}},
+		{ServiceFilter{Include: []string{"api*"}, Exclude: []string{"*-admin"}}, [][]string{{"api"}}},
+		{ServiceFilter{Exclude: []string{"datadog*"}}, [][]string{{"api", "api-admin", "web"}}},
+		{ServiceFilter{Include: []string{"prod"}}, [][]string{nil}},
+	}
+	for _, tt := range tests {
+		filtered, err := es.FilterServices(servicesInfo, "prod", tt.filter)
+		if err != nil {
+			t.Fatalf("%+v: unexpected error: %s", tt.filter, err)
+		}
+		if got := serviceNames([][]ServiceInfo{filtered}); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("FilterServices() with %+v = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestECSService_clusterServicesImages(t *testing.T) {
+	fake := &fakeECS{tasks: map[string]string{"api": "api:2", "worker": "worker:7"}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	es := newFakeECSService(server)
+	servicesInfo, err := es.clusterServices("prod", RollbackOptions{Images: map[string]string{"api": "v1.2"}})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	want := []ServiceInfo{
+		{ARN: "arn:aws:ecs:us-east-1:123456789012:service/prod/api", Image: "v1.2"},
+		{ARN: "arn:aws:ecs:us-east-1:123456789012:service/prod/worker"},
+	}
+	if !reflect.DeepEqual(servicesInfo, want) {
+		t.Errorf("clusterServices() = %+v, want %+v", servicesInfo, want)
+	}
+	_, err = es.clusterServices("prod", RollbackOptions{Images: map[string]string{"web": "v1.2"}})
+	if err == nil || !strings.Contains(err.Error(), `service "web" not found`) {
+		t.Error("expected error for service not in cluster, got:", err)
+	}
+}
+
+func TestECSService_CheckDeploymentsRedoing(t *testing.T) {
+	fake := &fakeECS{
+		tasks:      map[string]string{"web": "web:5", "api": "api:3"},
+		inProgress: map[string]bool{"web": true},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	es := newFakeECSService(server)
+	err := es.CheckDeployments([]string{"web", "api"}, "prod", RollbackOptions{})
+	if err == nil || !strings.Contains(err.Error(), `"web"`) {
+		t.Fatal("deployment in progress not reported:", err)
+	}
+	// Journaled by the service command with the name given by the user.
+	opts := RollbackOptions{Redoing: map[string]string{"web": "web:5"}}
+	if err := es.CheckDeployments([]string{"web", "api"}, "prod", opts); err != nil {
+		t.Fatal("rollout being redone refused:", err)
+	}
+	opts = RollbackOptions{Redoing: map[string]string{"web": "web:4"}}
+	if err := es.CheckDeployments([]string{"web"}, "prod", opts); err == nil {
+		t.Fatal("other rollout not refused")
+	}
+}
+
+func TestECSService_ClusterRestoreStopped(t *testing.T) {
+	fake := &fakeECS{tasks: map[string]string{"api": "api:2"}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	es := newFakeECSService(server)
+	opts := RollbackOptions{Force: true, AllowBarrier: true, Proceed: func() error {
+		return errors.New("lock lost")
+	}}
+	changes, err := es.ClusterRestore([]ServiceInfo{{ARN: "api", TaskARN: "api:1"}}, "my-cluster", opts)
+	if len(changes) != 0 {
+		t.Error("services changed:", changes)
+	}
+	rbErr, ok := err.(*RollbackError)
+	if !ok || len(rbErr.Failures) != 1 || rbErr.Failures[0].Err.Error() != "lock lost" {
+		t.Fatalf("failure not reported: %#v", err)
+	}
+	if fake.tasks["api"] != "api:2" {
+		t.Error("service updated:", fake.tasks)
+	}
+}
+
+func TestECSService_ServiceHistoryCurrent(t *testing.T) {
+	const task = "arn:aws:ecs:us-east-1:123456789012:task-definition/web:"
+	now := time.Now()
+	fake := &fakeECS{
+		// Rolled back to web:2.
+		tasks:      map[string]string{"web": task + "2"},
+		registered: make(map[string]time.Time),
+	}
+	for revision := 1; revision <= 6; revision++ {
+		fake.registered[task+strconv.Itoa(revision)] = now.Add(time.Duration(revision) * time.Hour)
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	es := newFakeECSService(server)
+	versions, err := es.ServiceHistory("web", "prod", 3)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	var got []string
+	for _, version := range versions {
+		name := TaskName(version.ARN)
+		if version.Current {
+			name += " current"
+		}
+		got = append(got, name)
+	}
+	want := []string{"web:6", "web:5", "web:4", "web:2 current"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ServiceHistory() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package aws
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+)
+
+// healthPollInterval is the time between checks of target health.
+var healthPollInterval = 10 * time.Second
+
+// WaitTargetsHealthy waits until targets of the tasks running taskARN are
+// healthy in all target groups of the service load balancers. Services
+// without target groups are considered healthy.
+func (es *ECSService) WaitTargetsHealthy(serviceName, clusterName, taskARN string, timeout time.Duration) error {
+	service, err := es.describeService(serviceName, clusterName)
+	if err != nil {
+		return fmt.Errorf(awsApisErrorFmt, err)
+	}
+	loadBalancers := make([]*ecs.LoadBalancer, 0, len(service.LoadBalancers))
+	for _, lb := range service.LoadBalancers {
+		if lb.TargetGroupArn != nil {
+			loadBalancers = append(loadBalancers, lb)
+		}
+	}
+	if len(loadBalancers) == 0 {
+		if es.verbose {
+			fmt.Printf("%q has no target groups, health check skipped\n", ServiceName(serviceName))
+		}
+		return nil
+	}
+	desired := int(aws.Int64Value(service.DesiredCount))
+	deadline := time.Now().Add(timeout)
+	for {
+		unhealthy, err := es.unhealthyTargets(serviceName, clusterName, taskARN, desired, loadBalancers)
+		if err != nil {
+			return err
+		}
+		if len(unhealthy) == 0 {
+			return nil
+		}
+		if es.verbose {
+			fmt.Printf("%q waiting for targets: %s\n", ServiceName(serviceName), strings.Join(unhealthy, ", "))
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return fmt.Errorf("targets not healthy after %s: %s", timeout, strings.Join(unhealthy, ", "))
+		}
+		if wait > healthPollInterval {
+			wait = healthPollInterval
+		}
+		time.Sleep(wait)
+	}
+}
+
+// unhealthyTargets returns targets of the tasks running taskARN that are not
+// healthy, with their state and reason. Tasks that are not running yet are
+// reported too.
+func (es *ECSService) unhealthyTargets(serviceName, clusterName, taskARN string, desired int, loadBalancers []*ecs.LoadBalancer) ([]string, error) {
+	tasks, err := es.serviceTasks(serviceName, clusterName, taskARN)
+	if err != nil {
+		return nil, fmt.Errorf(awsApisErrorFmt, err)
+	}
+	instanceIDs, err := es.instanceIDs(clusterName, tasks)
+	if err != nil {
+		return nil, fmt.Errorf(awsApisErrorFmt, err)
+	}
+	var unhealthy []string
+	if len(tasks) < desired {
+		unhealthy = append(unhealthy, fmt.Sprintf("%d of %d tasks running", len(tasks), desired))
+	}
+	for _, lb := range loadBalancers {
+		out, err := es.elb.DescribeTargetHealth(&elbv2.DescribeTargetHealthInput{
+			TargetGroupArn: lb.TargetGroupArn,
+		})
+		if err != nil {
+			return nil, fmt.Errorf(awsApisErrorFmt, err)
+		}
+		var targets []string
+		for _, task := range tasks {
+			targets = append(targets, taskTargets(task, lb, instanceIDs)...)
+		}
+		unhealthy = append(unhealthy, targetsHealth(targets, out.TargetHealthDescriptions)...)
+	}
+	return unhealthy, nil
+}
+
+// serviceTasks returns running tasks of a service that use taskARN.
+func (es *ECSService) serviceTasks(serviceName, clusterName, taskARN string) ([]*ecs.Task, error) {
+	var taskARNs []*string
+	err := es.client.ListTasksPages(&ecs.ListTasksInput{
+		Cluster:       aws.String(clusterName),
+		ServiceName:   aws.String(ServiceName(serviceName)),
+		DesiredStatus: aws.String(ecs.DesiredStatusRunning),
+	}, func(page *ecs.ListTasksOutput, lastPage bool) bool {
+		taskARNs = append(taskARNs, page.TaskArns...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	var tasks []*ecs.Task
+	// DescribeTasks accepts at most 100 tasks for each call.
+	for i := 0; i < len(taskARNs); i += 100 {
+		end := i + 100
+		if end > len(taskARNs) {
+			end = len(taskARNs)
+		}
+		out, err := es.client.DescribeTasks(&ecs.DescribeTasksInput{
+			Cluster: aws.String(clusterName),
+			Tasks:   taskARNs[i:end],
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, task := range out.Tasks {
+			if aws.StringValue(task.TaskDefinitionArn) == taskARN &&
+				aws.StringValue(task.LastStatus) == ecs.DesiredStatusRunning {
+				tasks = append(tasks, task)
+			}
+		}
+	}
+	return tasks, nil
+}
+
+// instanceIDs returns EC2 instance IDs by container instance ARN for the
+// tasks that run on container instances.
+func (es *ECSService) instanceIDs(clusterName string, tasks []*ecs.Task) (map[string]string, error) {
+	seen := make(map[string]bool)
+	var containerInstances []*string
+	for _, task := range tasks {
+		if task.ContainerInstanceArn == nil || seen[*task.ContainerInstanceArn] {
+			continue
+		}
+		seen[*task.ContainerInstanceArn] = true
+		containerInstances = append(containerInstances, task.ContainerInstanceArn)
+	}
+	ids := make(map[string]string, len(containerInstances))
+	if len(containerInstances) == 0 {
+		return ids, nil
+	}
+	out, err := es.client.DescribeContainerInstances(&ecs.DescribeContainerInstancesInput{
+		Cluster:            aws.String(clusterName),
+		ContainerInstances: containerInstances,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, ci := range out.ContainerInstances {
+		ids[aws.StringValue(ci.ContainerInstanceArn)] = aws.StringValue(ci.Ec2InstanceId)
+	}
+	return ids, nil
+}
+
+// taskTargets returns the targets, in the form id:port, a task registers in
+// the target group of a load balancer. Tasks using awsvpc network mode
+// register their IP address, the others the EC2 instance they run on with
+// the host port.
+func taskTargets(task *ecs.Task, lb *ecs.LoadBalancer, instanceIDs map[string]string) []string {
+	containerPort := aws.Int64Value(lb.ContainerPort)
+	for _, attachment := range task.Attachments {
+		if aws.StringValue(attachment.Type) != "ElasticNetworkInterface" {
+			continue
+		}
+		for _, detail := range attachment.Details {
+			if aws.StringValue(detail.Name) == "privateIPv4Address" {
+				return []string{fmt.Sprintf("%s:%d", aws.StringValue(detail.Value), containerPort)}
+			}
+		}
+	}
+	instanceID := instanceIDs[aws.StringValue(task.ContainerInstanceArn)]
+	var targets []string
+	for _, container := range task.Containers {
+		if aws.StringValue(container.Name) != aws.StringValue(lb.ContainerName) {
+			continue
+		}
+		for _, binding := range container.NetworkBindings {
+			if aws.Int64Value(binding.ContainerPort) == containerPort {
+				targets = append(targets, fmt.Sprintf("%s:%d", instanceID, aws.Int64Value(binding.HostPort)))
+			}
+		}
+	}
+	return targets
+}
+
+// targetsHealth returns targets that are not healthy according to target
+// health descriptions, with their state and reason code.
+func targetsHealth(targets []string, descriptions []*elbv2.TargetHealthDescription) []string {
+	health := make(map[string]*elbv2.TargetHealth, len(descriptions))
+	for _, d := range descriptions {
+		if d.Target == nil {
+			continue
+		}
+		target := fmt.Sprintf("%s:%d", aws.StringValue(d.Target.Id), aws.Int64Value(d.Target.Port))
+		health[target] = d.TargetHealth
+	}
+	var unhealthy []string
+	for _, target := range targets {
+		h, ok := health[target]
+		switch {
+		case !ok:
+			unhealthy = append(unhealthy, target+" not registered")
+		case aws.StringValue(h.State) != elbv2.TargetHealthStateEnumHealthy:
+			unhealthy = append(unhealthy, fmt.Sprintf("%s %s (%s)", target, aws.StringValue(h.State), aws.StringValue(h.Reason)))
+		}
+	}
+	sort.Strings(unhealthy)
+	return unhealthy
+}
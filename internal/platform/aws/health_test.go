@@ -0,0 +1,104 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package aws
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+)
+
+func Test_taskTargets(t *testing.T) {
+	lb := &ecs.LoadBalancer{
+		ContainerName:  aws.String("app"),
+		ContainerPort:  aws.Int64(8080),
+		TargetGroupArn: aws.String("arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/app/1"),
+	}
+	awsvpcTask := &ecs.Task{
+		Attachments: []*ecs.Attachment{{
+			Type: aws.String("ElasticNetworkInterface"),
+			Details: []*ecs.KeyValuePair{
+				{Name: aws.String("subnetId"), Value: aws.String("subnet-1")},
+				{Name: aws.String("privateIPv4Address"), Value: aws.String("10.0.1.12")},
+			},
+		}},
+	}
+	bridgeTask := &ecs.Task{
+		ContainerInstanceArn: aws.String("ci-1"),
+		Containers: []*ecs.Container{
+			{
+				Name:            aws.String("sidecar"),
+				NetworkBindings: []*ecs.NetworkBinding{{ContainerPort: aws.Int64(8080), HostPort: aws.Int64(32001)}},
+			},
+			{
+				Name:            aws.String("app"),
+				NetworkBindings: []*ecs.NetworkBinding{{ContainerPort: aws.Int64(8080), HostPort: aws.Int64(32768)}},
+			},
+		},
+	}
+	instanceIDs := map[string]string{"ci-1": "i-0abc"}
+	tests := []struct {
+		name string
+		task *ecs.Task
+		want []string
+	}{
+		{"awsvpc", awsvpcTask, []string{"10.0.1.12:8080"}},
+		{"bridge", bridgeTask, []string{"i-0abc:32768"}},
+	}
+	for _, tt := range tests {
+		if got := taskTargets(tt.task, lb, instanceIDs); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: taskTargets() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func Test_targetsHealth(t *testing.T) {
+	description := func(id string, port int64, state, reason string) *elbv2.TargetHealthDescription {
+		d := &elbv2.TargetHealthDescription{
+			Target:       &elbv2.TargetDescription{Id: aws.String(id), Port: aws.Int64(port)},
+			TargetHealth: &elbv2.TargetHealth{State: aws.String(state)},
+		}
+		if reason != "" {
+			d.TargetHealth.Reason = aws.String(reason)
+		}
+		return d
+	}
+	descriptions := []*elbv2.TargetHealthDescription{
+		description("10.0.1.12", 8080, "healthy", ""),
+		description("10.0.1.13", 8080, "unhealthy", "Target.FailedHealthChecks"),
+		description("10.0.1.14", 8080, "initial", "Elb.RegistrationInProgress"),
+	}
+	targets := []string{"10.0.1.12:8080", "10.0.1.13:8080", "10.0.1.14:8080", "10.0.1.15:8080"}
+	want := []string{
+		"10.0.1.13:8080 unhealthy (Target.FailedHealthChecks)",
+		"10.0.1.14:8080 initial (Elb.RegistrationInProgress)",
+		"10.0.1.15:8080 not registered",
+	}
+	if got := targetsHealth(targets, descriptions); !reflect.DeepEqual(got, want) {
+		t.Errorf("targetsHealth() = %v, want %v", got, want)
+	}
+	if got := targetsHealth(targets[:1], descriptions); len(got) != 0 {
+		t.Errorf("targetsHealth() = %v, want none", got)
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package aws
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudtrail"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// trailRetention is how far back CloudTrail event history goes.
+const trailRetention = 90 * 24 * time.Hour
+
+// deployment is a task version a service has been deployed with.
+type deployment struct {
+	TaskARN string
+	At      time.Time
+}
+
+// trailEvents are the calls recorded by CloudTrail that deploy a task
+// version on a service.
+var trailEvents = []string{"UpdateService", "CreateService"}
+
+// clusterTrail holds deployments of the services of a cluster recorded by
+// CloudTrail. Events are read newest first, a page at a time and only as far
+// back as services need, events of other clusters are dropped as they are
+// read.
+type clusterTrail struct {
+	mu          sync.Mutex
+	clusterARN  string
+	deployments map[string][]deployment
+	// start is the time events are available from.
+	start   time.Time
+	streams []*trailStream
+	err     error
+}
+
+// trailStream is the lookup of the events of a call.
+type trailStream struct {
+	input *cloudtrail.LookupEventsInput
+	// oldest is the time events have been read back to.
+	oldest time.Time
+	done   bool
+}
+
+// serviceDeployments returns the task versions a service has been deployed
+// with, newest first: its active deployments and UpdateService and
+// CreateService calls recorded by CloudTrail. CloudTrail is read until
+// enough reports the deployments found, complete from since, suffice, or
+// events run out. It also returns the time history is complete from, zero if
+// CloudTrail is not available: revisions registered after it and missing
+// from history have never been deployed on the service.
+func (es *ECSService) serviceDeployments(service *ecs.Service, enough func(deployments []deployment, since time.Time) bool) ([]deployment, time.Time) {
+	active := make([]deployment, 0, len(service.Deployments))
+	for _, d := range service.Deployments {
+		if d.TaskDefinition == nil || d.CreatedAt == nil {
+			continue
+		}
+		active = append(active, deployment{TaskARN: *d.TaskDefinition, At: *d.CreatedAt})
+	}
+	merge := func(recorded []deployment) []deployment {
+		deployments := make([]deployment, 0, len(active)+len(recorded))
+		deployments = append(deployments, active...)
+		return sortDeployments(append(deployments, recorded...))
+	}
+	serviceARN := aws.StringValue(service.ServiceArn)
+	trail := es.clusterTrail(aws.StringValue(service.ClusterArn))
+	recorded, since, err := trail.serviceDeployments(es.trail, serviceARN, func(recorded []deployment, since time.Time) bool {
+		return enough(merge(recorded), since)
+	})
+	if err != nil {
+		if es.verbose {
+			fmt.Printf("%q: deployment history from CloudTrail not available: %s\n", ServiceName(serviceARN), err)
+		}
+		return merge(nil), time.Time{}
+	}
+	return merge(recorded), since
+}
+
+// clusterTrail returns deployments of the services of a cluster recorded by
+// CloudTrail.
+func (es *ECSService) clusterTrail(clusterARN string) *clusterTrail {
+	es.trailsMu.Lock()
+	defer es.trailsMu.Unlock()
+	if es.trails == nil {
+		es.trails = make(map[string]*clusterTrail)
+	}
+	trail, ok := es.trails[clusterARN]
+	if !ok {
+		trail = newClusterTrail(clusterARN, time.Now())
+		es.trails[clusterARN] = trail
+	}
+	return trail
+}
+
+// newClusterTrail returns deployments of a cluster to be read from events
+// recorded until end.
+func newClusterTrail(clusterARN string, end time.Time) *clusterTrail {
+	trail := &clusterTrail{
+		clusterARN:  clusterARN,
+		deployments: make(map[string][]deployment),
+		start:       end.Add(-trailRetention),
+	}
+	for _, name := range trailEvents {
+		trail.streams = append(trail.streams, &trailStream{
+			input: &cloudtrail.LookupEventsInput{
+				LookupAttributes: []*cloudtrail.LookupAttribute{{
+					AttributeKey:   aws.String(cloudtrail.LookupAttributeKeyEventName),
+					AttributeValue: aws.String(name),
+				}},
+				StartTime: aws.Time(trail.start),
+				EndTime:   aws.Time(end),
+			},
+			oldest: end,
+		})
+	}
+	return trail
+}
+
+// serviceDeployments returns deployments of a service read so far, reading
+// more events until enough reports they suffice or events run out. It also
+// returns the time deployments are complete from.
+func (t *clusterTrail) serviceDeployments(client *cloudtrail.CloudTrail, serviceARN string, enough func(deployments []deployment, since time.Time) bool) ([]deployment, time.Time, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.err == nil && !enough(t.deployments[serviceARN], t.since()) {
+		stream := t.next()
+		if stream == nil {
+			break
+		}
+		if client == nil {
+			t.err = fmt.Errorf("no CloudTrail client")
+			break
+		}
+		out, err := client.LookupEvents(stream.input)
+		if err != nil {
+			t.err = fmt.Errorf(awsApisErrorFmt, err)
+			break
+		}
+		t.add(stream, out)
+	}
+	deployments := append([]deployment(nil), t.deployments[serviceARN]...)
+	return deployments, t.since(), t.err
+}
+
+// next returns the stream to read a page from, the one read back the least
+// so that all go back in time together, or nil if all have been read.
+func (t *clusterTrail) next() *trailStream {
+	var next *trailStream
+	for _, stream := range t.streams {
+		if !stream.done && (next == nil || stream.oldest.After(next.oldest)) {
+			next = stream
+		}
+	}
+	return next
+}
+
+// add records deployments of the cluster found in a page of events.
+func (t *clusterTrail) add(stream *trailStream, out *cloudtrail.LookupEventsOutput) {
+	for serviceARN, deployments := range trailDeployments(out.Events, t.clusterARN) {
+		t.deployments[serviceARN] = append(t.deployments[serviceARN], deployments...)
+	}
+	if n := len(out.Events); n > 0 && out.Events[n-1].EventTime != nil {
+		stream.oldest = *out.Events[n-1].EventTime
+	}
+	stream.input.NextToken = out.NextToken
+	stream.done = out.NextToken == nil
+}
+
+// since returns the time deployments read so far are complete from.
+func (t *clusterTrail) since() time.Time {
+	since := t.start
+	for _, stream := range t.streams {
+		if !stream.done && stream.oldest.After(since) {
+			since = stream.oldest
+		}
+	}
+	return since
+}
+
+// trailDeployments returns deployments of the services of a cluster made by
+// successful CreateService and UpdateService calls among CloudTrail events.
+// Calls not setting a task definition, e.g. scaling ones, are skipped.
+func trailDeployments(events []*cloudtrail.Event, clusterARN string) map[string][]deployment {
+	deployments := make(map[string][]deployment)
+	for _, event := range events {
+		var record struct {
+			ErrorCode         string `json:"errorCode"`
+			RequestParameters struct {
+				TaskDefinition string `json:"taskDefinition"`
+			} `json:"requestParameters"`
+			ResponseElements struct {
+				Service struct {
+					ServiceARN     string `json:"serviceArn"`
+					ClusterARN     string `json:"clusterArn"`
+					TaskDefinition string `json:"taskDefinition"`
+				} `json:"service"`
+			} `json:"responseElements"`
+		}
+		if event.EventTime == nil || json.Unmarshal([]byte(aws.StringValue(event.CloudTrailEvent)), &record) != nil {
+			continue
+		}
+		service := record.ResponseElements.Service
+		if record.ErrorCode != "" || record.RequestParameters.TaskDefinition == "" {
+			continue
+		}
+		if service.ClusterARN != clusterARN || service.TaskDefinition == "" {
+			continue
+		}
+		deployments[service.ServiceARN] = append(
+			deployments[service.ServiceARN],
+			deployment{TaskARN: service.TaskDefinition, At: *event.EventTime},
+		)
+	}
+	return deployments
+}
+
+// sortDeployments sorts deployments newest first, removing duplicates.
+func sortDeployments(deployments []deployment) []deployment {
+	sort.SliceStable(deployments, func(i, j int) bool {
+		return deployments[i].At.After(deployments[j].At)
+	})
+	sorted := deployments[:0]
+	for i, d := range deployments {
+		if i > 0 && d == deployments[i-1] {
+			continue
+		}
+		sorted = append(sorted, d)
+	}
+	return sorted
+}
+
+// deploymentAt returns the task version deployed at a given time, or an
+// empty string if deployments, newest first, do not go back to it.
+func deploymentAt(deployments []deployment, at time.Time) string {
+	for _, d := range deployments {
+		if !d.At.After(at) {
+			return d.TaskARN
+		}
+	}
+	return ""
+}
+
+// isMissingTaskDefinition reports whether err is returned describing a task
+// definition that does not exist any more.
+func isMissingTaskDefinition(err error) bool {
+	e, ok := err.(awserr.Error)
+	if !ok || e.Code() != ecs.ErrCodeClientException {
+		return false
+	}
+	return strings.Contains(strings.ToLower(e.Message()), "does not exist")
+}
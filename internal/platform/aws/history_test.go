@@ -0,0 +1,280 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package aws
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudtrail"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func Test_trailDeployments(t *testing.T) {
+	const (
+		cluster = "arn:aws:ecs:us-east-1:123456789012:cluster/prod"
+		service = "arn:aws:ecs:us-east-1:123456789012:service/prod/api"
+		task    = "arn:aws:ecs:us-east-1:123456789012:task-definition/api:"
+	)
+	now := time.Now()
+	events := []*cloudtrail.Event{
+		trailEvent(cluster, service, task+"7", now),
+		// Failed call.
+		{CloudTrailEvent: aws.String(`{"errorCode":"InvalidParameterException","responseElements":null}`), EventTime: aws.Time(now)},
+		// Other cluster.
+		trailEvent("arn:aws:ecs:us-east-1:123456789012:cluster/dev", service, task+"9", now),
+		// Scaling, no task definition set.
+		{
+			CloudTrailEvent: aws.String(`{"requestParameters":{"desiredCount":4},"responseElements":{"service":{"serviceArn":"` + service + `","clusterArn":"` + cluster + `","taskDefinition":"` + task + `7"}}}`),
+			EventTime:       aws.Time(now),
+		},
+		{CloudTrailEvent: aws.String(`not json`), EventTime: aws.Time(now)},
+		trailEvent(cluster, service, task+"5", now.Add(-time.Hour)),
+	}
+	want := map[string][]deployment{
+		service: {
+			{TaskARN: task + "7", At: now},
+			{TaskARN: task + "5", At: now.Add(-time.Hour)},
+		},
+	}
+	if got := trailDeployments(events, cluster); !reflect.DeepEqual(got, want) {
+		t.Errorf("trailDeployments() = %v, want %v", got, want)
+	}
+}
+
+// trailEvent returns the CloudTrail event of a call deploying a task
+// definition on a service.
+func trailEvent(clusterARN, serviceARN, taskARN string, at time.Time) *cloudtrail.Event {
+	record := `{"requestParameters":{"taskDefinition":"` + taskARN + `"},` +
+		`"responseElements":{"service":{"serviceArn":"` + serviceARN + `","clusterArn":"` + clusterARN + `","taskDefinition":"` + taskARN + `"}}}`
+	return &cloudtrail.Event{CloudTrailEvent: aws.String(record), EventTime: aws.Time(at)}
+}
+
+// fakeTrail serves LookupEvents, a page for every call, from pages of events
+// of every event name.
+type fakeTrail struct {
+	mu    sync.Mutex
+	pages map[string][][]*cloudtrail.Event
+	calls int
+}
+
+func (f *fakeTrail) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	var input struct {
+		LookupAttributes []struct{ AttributeValue string }
+		NextToken        string
+	}
+	json.NewDecoder(r.Body).Decode(&input)
+	pages := f.pages[input.LookupAttributes[0].AttributeValue]
+	page, _ := strconv.Atoi(input.NextToken)
+	out := map[string]interface{}{}
+	events := make([]map[string]interface{}, 0)
+	if page < len(pages) {
+		for _, event := range pages[page] {
+			events = append(events, map[string]interface{}{
+				"CloudTrailEvent": *event.CloudTrailEvent,
+				"EventTime":       float64(event.EventTime.Unix()),
+			})
+		}
+	}
+	out["Events"] = events
+	if page+1 < len(pages) {
+		out["NextToken"] = strconv.Itoa(page + 1)
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	json.NewEncoder(w).Encode(out)
+}
+
+func Test_clusterTrailReadsAsNeeded(t *testing.T) {
+	const (
+		cluster = "arn:aws:ecs:us-east-1:123456789012:cluster/prod"
+		other   = "arn:aws:ecs:us-east-1:123456789012:cluster/dev"
+		api     = "arn:aws:ecs:us-east-1:123456789012:service/prod/api"
+		web     = "arn:aws:ecs:us-east-1:123456789012:service/prod/web"
+		task    = "arn:aws:ecs:us-east-1:123456789012:task-definition/"
+	)
+	end := time.Now().Truncate(time.Second).UTC()
+	hours := func(n int) time.Time { return end.Add(-time.Duration(n) * time.Hour) }
+	fake := &fakeTrail{pages: map[string][][]*cloudtrail.Event{
+		"UpdateService": {
+			{trailEvent(cluster, api, task+"api:9", hours(1)), trailEvent(other, api, task+"api:3", hours(2))},
+			{trailEvent(cluster, web, task+"web:4", hours(3)), trailEvent(cluster, api, task+"api:8", hours(4))},
+			{trailEvent(cluster, web, task+"web:3", hours(5))},
+		},
+		"CreateService": {
+			{trailEvent(cluster, web, task+"web:1", hours(6))},
+		},
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+	client := cloudtrail.New(sess)
+	trail := newClusterTrail(cluster, end)
+	deployments, since, err := trail.serviceDeployments(client, api, func(deployments []deployment, _ time.Time) bool {
+		return len(deployments) >= 2
+	})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	want := []deployment{{TaskARN: task + "api:9", At: hours(1)}, {TaskARN: task + "api:8", At: hours(4)}}
+	if !reflect.DeepEqual(deployments, want) {
+		t.Errorf("deployments = %v, want %v", deployments, want)
+	}
+	// Two pages of UpdateService, the first of CreateService is read
+	// when UpdateService goes back further.
+	if fake.calls != 3 {
+		t.Errorf("%d pages read, want 3", fake.calls)
+	}
+	if !since.Equal(hours(4)) {
+		t.Errorf("since = %s, want %s", since, hours(4))
+	}
+	// Events already read are enough.
+	if _, _, err := trail.serviceDeployments(client, web, func(deployments []deployment, _ time.Time) bool {
+		return len(deployments) >= 1
+	}); err != nil || fake.calls != 3 {
+		t.Errorf("more pages read, calls %d, error %v", fake.calls, err)
+	}
+	deployments, since, err = trail.serviceDeployments(client, web, func(deployments []deployment, _ time.Time) bool {
+		return false
+	})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(deployments) != 3 || fake.calls != 4 {
+		t.Errorf("deployments = %v after %d calls, want all 3 after 4 calls", deployments, fake.calls)
+	}
+	if !since.Equal(trail.start) {
+		t.Errorf("since = %s, want start of events %s", since, trail.start)
+	}
+}
+
+func TestECSService_ServicePreviousVersionAfterRollback(t *testing.T) {
+	const (
+		cluster = "arn:aws:ecs:us-east-1:123456789012:cluster/prod"
+		web     = "arn:aws:ecs:us-east-1:123456789012:service/prod/web"
+		task    = "arn:aws:ecs:us-east-1:123456789012:task-definition/web:"
+	)
+	now := time.Now().Truncate(time.Second).UTC()
+	hours := func(n int) time.Time { return now.Add(-time.Duration(n) * time.Hour) }
+	// web:11 was a bad release, it has been rolled back to web:10.
+	fakeService := &fakeECS{
+		tasks:      map[string]string{web: task + "10"},
+		registered: map[string]time.Time{task + "9": hours(10), task + "10": hours(8), task + "11": hours(6)},
+	}
+	ecsServer := httptest.NewServer(fakeService)
+	defer ecsServer.Close()
+	fakeEvents := &fakeTrail{pages: map[string][][]*cloudtrail.Event{
+		"UpdateService": {
+			{trailEvent(cluster, web, task+"10", hours(1)), trailEvent(cluster, web, task+"11", hours(5))},
+			{trailEvent(cluster, web, task+"10", hours(7)), trailEvent(cluster, web, task+"9", hours(9))},
+		},
+	}}
+	trailServer := httptest.NewServer(fakeEvents)
+	defer trailServer.Close()
+	es := newFakeECSService(ecsServer)
+	es.trail = cloudtrail.New(session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(trailServer.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})))
+	taskARN, strategy, err := es.ServicePreviousVersion(web, "prod", 1)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if taskARN != task+"9" || strategy != FromHistory {
+		t.Errorf("previous version = %s from %s, want %s from %s", taskARN, strategy, task+"9", FromHistory)
+	}
+}
+
+func Test_sortDeployments(t *testing.T) {
+	now := time.Now()
+	deployments := []deployment{
+		{TaskARN: "app:5", At: now.Add(-time.Hour)},
+		{TaskARN: "app:7", At: now},
+		{TaskARN: "app:5", At: now.Add(-time.Hour)},
+	}
+	want := []deployment{
+		{TaskARN: "app:7", At: now},
+		{TaskARN: "app:5", At: now.Add(-time.Hour)},
+	}
+	if got := sortDeployments(deployments); !reflect.DeepEqual(got, want) {
+		t.Errorf("sortDeployments() = %v, want %v", got, want)
+	}
+}
+
+func Test_deploymentAt(t *testing.T) {
+	now := time.Now()
+	deployments := []deployment{
+		{TaskARN: "app:10", At: now.Add(-time.Hour)},
+		{TaskARN: "app:9", At: now.Add(-3 * time.Hour)},
+		{TaskARN: "app:8", At: now.Add(-5 * time.Hour)},
+	}
+	tests := []struct {
+		at   time.Time
+		want string
+	}{
+		{at: now, want: "app:10"},
+		{at: now.Add(-time.Hour), want: "app:10"},
+		{at: now.Add(-2 * time.Hour), want: "app:9"},
+		{at: now.Add(-4 * time.Hour), want: "app:8"},
+		{at: now.Add(-6 * time.Hour), want: ""},
+	}
+	for _, tt := range tests {
+		if got := deploymentAt(deployments, tt.at); got != tt.want {
+			t.Errorf("deploymentAt(%s) = %v, want %v", tt.at, got, tt.want)
+		}
+	}
+}
+
+func Test_isMissingTaskDefinition(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{awserr.New(ecs.ErrCodeClientException, "The specified task definition does not exist.", nil), true},
+		{awserr.New(ecs.ErrCodeClientException, "User is not authorized to perform: ecs:DescribeTaskDefinition", nil), false},
+		{awserr.New(ecs.ErrCodeServerException, "does not exist", nil), false},
+		{errors.New("does not exist"), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := isMissingTaskDefinition(tt.err); got != tt.want {
+			t.Errorf("isMissingTaskDefinition(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
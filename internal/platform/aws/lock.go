@@ -0,0 +1,373 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/eraclitux/ecsundo/internal/lock"
+)
+
+// Locker returns a lock.Locker using the given backend: dynamodb, keeping
+// locks in a table with a cluster string partition key, or tag, keeping
+// locks in tags of the cluster.
+func (es *ECSService) Locker(backend, table string) (lock.Locker, error) {
+	switch backend {
+	case "dynamodb":
+		if table == "" {
+			return nil, errors.New("a table is needed for dynamodb lock")
+		}
+		return &dynamoDBLocker{client: es.db, table: table}, nil
+	case "tag":
+		return &tagLocker{es: es}, nil
+	default:
+		return nil, fmt.Errorf("unknown lock backend %q", backend)
+	}
+}
+
+// dynamoDBLocker keeps locks in a DynamoDB table, using conditional writes
+// so that a lock is acquired by a single run.
+type dynamoDBLocker struct {
+	client *dynamodb.DynamoDB
+	table  string
+}
+
+func (dl *dynamoDBLocker) key(cluster string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"cluster": {S: aws.String(cluster)},
+	}
+}
+
+// Acquire writes the lock item of a cluster if it does not exist or it is
+// expired.
+func (dl *dynamoDBLocker) Acquire(cluster string, info lock.Info) error {
+	for {
+		_, err := dl.client.PutItem(&dynamodb.PutItemInput{
+			TableName: aws.String(dl.table),
+			Item: map[string]*dynamodb.AttributeValue{
+				"cluster":     {S: aws.String(cluster)},
+				"id":          {S: aws.String(info.ID)},
+				"holder":      {S: aws.String(info.Holder)},
+				"command":     {S: aws.String(info.Command)},
+				"acquired_at": {S: aws.String(info.AcquiredAt.Format(time.RFC3339))},
+				"expires_at":  {N: aws.String(strconv.FormatInt(info.ExpiresAt.Unix(), 10))},
+			},
+			ConditionExpression: aws.String("attribute_not_exists(#cluster) OR #expires_at < :now"),
+			ExpressionAttributeNames: map[string]*string{
+				"#cluster":    aws.String("cluster"),
+				"#expires_at": aws.String("expires_at"),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":now": {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+			},
+		})
+		if !isErrorCode(err, dynamodb.ErrCodeConditionalCheckFailedException) {
+			if err != nil {
+				return fmt.Errorf(awsApisErrorFmt, err)
+			}
+			return nil
+		}
+		current, err := dl.Status(cluster)
+		if err != nil {
+			return err
+		}
+		// If lock has been released in the meantime try again.
+		if current != nil {
+			return &lock.LockedError{Cluster: cluster, Info: *current}
+		}
+	}
+}
+
+// Refresh updates the expiration of the lock item of a cluster if it holds
+// info.
+func (dl *dynamoDBLocker) Refresh(cluster string, info lock.Info) error {
+	_, err := dl.client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(dl.table),
+		Key:                 dl.key(cluster),
+		UpdateExpression:    aws.String("SET #expires_at = :expires_at"),
+		ConditionExpression: aws.String("#id = :id"),
+		ExpressionAttributeNames: map[string]*string{
+			"#id":         aws.String("id"),
+			"#expires_at": aws.String("expires_at"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":id":         {S: aws.String(info.ID)},
+			":expires_at": {N: aws.String(strconv.FormatInt(info.ExpiresAt.Unix(), 10))},
+		},
+	})
+	if !isErrorCode(err, dynamodb.ErrCodeConditionalCheckFailedException) {
+		if err != nil {
+			return fmt.Errorf(awsApisErrorFmt, err)
+		}
+		return nil
+	}
+	current, err := dl.Status(cluster)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return fmt.Errorf("lock of %q has been released", cluster)
+	}
+	return &lock.LockedError{Cluster: cluster, Info: *current}
+}
+
+// Release deletes the lock item of a cluster if it holds info.
+func (dl *dynamoDBLocker) Release(cluster string, info lock.Info) error {
+	_, err := dl.client.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:           aws.String(dl.table),
+		Key:                 dl.key(cluster),
+		ConditionExpression: aws.String("#id = :id"),
+		ExpressionAttributeNames: map[string]*string{
+			"#id": aws.String("id"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":id": {S: aws.String(info.ID)},
+		},
+	})
+	if err != nil && !isErrorCode(err, dynamodb.ErrCodeConditionalCheckFailedException) {
+		return fmt.Errorf(awsApisErrorFmt, err)
+	}
+	return nil
+}
+
+// Status reads the lock item of a cluster.
+func (dl *dynamoDBLocker) Status(cluster string) (*lock.Info, error) {
+	out, err := dl.client.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(dl.table),
+		Key:            dl.key(cluster),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf(awsApisErrorFmt, err)
+	}
+	if len(out.Item) == 0 {
+		return nil, nil
+	}
+	item := out.Item
+	value := func(name string) string {
+		if v, ok := item[name]; ok {
+			return aws.StringValue(v.S)
+		}
+		return ""
+	}
+	info := &lock.Info{
+		ID:      value("id"),
+		Holder:  value("holder"),
+		Command: value("command"),
+	}
+	info.AcquiredAt, _ = time.Parse(time.RFC3339, value("acquired_at"))
+	if v, ok := item["expires_at"]; ok {
+		expires, _ := strconv.ParseInt(aws.StringValue(v.N), 10, 64)
+		info.ExpiresAt = time.Unix(expires, 0)
+	}
+	return info, nil
+}
+
+// Break deletes the lock item of a cluster.
+func (dl *dynamoDBLocker) Break(cluster string) error {
+	_, err := dl.client.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(dl.table),
+		Key:       dl.key(cluster),
+	})
+	if err != nil {
+		return fmt.Errorf(awsApisErrorFmt, err)
+	}
+	return nil
+}
+
+// Tags of the cluster used by tagLocker.
+const (
+	lockTagID       = "ecsundo:lock-id"
+	lockTagHolder   = "ecsundo:lock-holder"
+	lockTagCommand  = "ecsundo:lock-command"
+	lockTagAcquired = "ecsundo:lock-acquired"
+	lockTagExpires  = "ecsundo:lock-expires"
+)
+
+// tagLocker keeps locks in tags of the cluster. Tags cannot be written
+// conditionally: the lock is read back after being written to detect
+// concurrent runs, but two runs can still acquire it at the same time.
+type tagLocker struct {
+	es *ECSService
+}
+
+func (tl *tagLocker) clusterARN(cluster string) (string, error) {
+	out, err := tl.es.client.DescribeClusters(&ecs.DescribeClustersInput{
+		Clusters: []*string{aws.String(cluster)},
+	})
+	if err != nil {
+		return "", fmt.Errorf(awsApisErrorFmt, err)
+	}
+	if len(out.Clusters) == 0 {
+		return "", fmt.Errorf("cluster %q not found", cluster)
+	}
+	return aws.StringValue(out.Clusters[0].ClusterArn), nil
+}
+
+// Acquire tags the cluster with the lock if it is not locked or the lock
+// is expired.
+func (tl *tagLocker) Acquire(cluster string, info lock.Info) error {
+	current, err := tl.Status(cluster)
+	if err != nil {
+		return err
+	}
+	if current != nil && !current.Expired(time.Now()) {
+		return &lock.LockedError{Cluster: cluster, Info: *current}
+	}
+	arn, err := tl.clusterARN(cluster)
+	if err != nil {
+		return err
+	}
+	tags := map[string]string{
+		lockTagID:       info.ID,
+		lockTagHolder:   tagValue(info.Holder),
+		lockTagCommand:  tagValue(info.Command),
+		lockTagAcquired: info.AcquiredAt.Format(time.RFC3339),
+		lockTagExpires:  info.ExpiresAt.Format(time.RFC3339),
+	}
+	input := &ecs.TagResourceInput{ResourceArn: aws.String(arn)}
+	for _, k := range sortedKeys(tags, nil) {
+		input.Tags = append(input.Tags, &ecs.Tag{Key: aws.String(k), Value: aws.String(tags[k])})
+	}
+	if _, err := tl.es.client.TagResource(input); err != nil {
+		return fmt.Errorf(awsApisErrorFmt, err)
+	}
+	current, err = tl.Status(cluster)
+	if err != nil {
+		return err
+	}
+	if current != nil && current.ID != info.ID {
+		return &lock.LockedError{Cluster: cluster, Info: *current}
+	}
+	return nil
+}
+
+// Refresh updates the expiration tag of the cluster if it holds info.
+func (tl *tagLocker) Refresh(cluster string, info lock.Info) error {
+	current, err := tl.Status(cluster)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return fmt.Errorf("lock of %q has been released", cluster)
+	}
+	if current.ID != info.ID {
+		return &lock.LockedError{Cluster: cluster, Info: *current}
+	}
+	arn, err := tl.clusterARN(cluster)
+	if err != nil {
+		return err
+	}
+	_, err = tl.es.client.TagResource(&ecs.TagResourceInput{
+		ResourceArn: aws.String(arn),
+		Tags: []*ecs.Tag{{
+			Key:   aws.String(lockTagExpires),
+			Value: aws.String(info.ExpiresAt.Format(time.RFC3339)),
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf(awsApisErrorFmt, err)
+	}
+	return nil
+}
+
+// Release removes lock tags from the cluster if it holds info.
+func (tl *tagLocker) Release(cluster string, info lock.Info) error {
+	current, err := tl.Status(cluster)
+	if err != nil || current == nil || current.ID != info.ID {
+		return err
+	}
+	return tl.Break(cluster)
+}
+
+// Status reads the lock from tags of the cluster.
+func (tl *tagLocker) Status(cluster string) (*lock.Info, error) {
+	arn, err := tl.clusterARN(cluster)
+	if err != nil {
+		return nil, err
+	}
+	out, err := tl.es.client.ListTagsForResource(&ecs.ListTagsForResourceInput{
+		ResourceArn: aws.String(arn),
+	})
+	if err != nil {
+		return nil, fmt.Errorf(awsApisErrorFmt, err)
+	}
+	tags := make(map[string]string, len(out.Tags))
+	for _, tag := range out.Tags {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	if tags[lockTagID] == "" {
+		return nil, nil
+	}
+	info := &lock.Info{
+		ID:      tags[lockTagID],
+		Holder:  tags[lockTagHolder],
+		Command: tags[lockTagCommand],
+	}
+	info.AcquiredAt, _ = time.Parse(time.RFC3339, tags[lockTagAcquired])
+	info.ExpiresAt, _ = time.Parse(time.RFC3339, tags[lockTagExpires])
+	return info, nil
+}
+
+// Break removes lock tags from the cluster.
+func (tl *tagLocker) Break(cluster string) error {
+	arn, err := tl.clusterARN(cluster)
+	if err != nil {
+		return err
+	}
+	_, err = tl.es.client.UntagResource(&ecs.UntagResourceInput{
+		ResourceArn: aws.String(arn),
+		TagKeys: aws.StringSlice([]string{
+			lockTagID, lockTagHolder, lockTagCommand, lockTagAcquired, lockTagExpires,
+		}),
+	})
+	if err != nil {
+		return fmt.Errorf(awsApisErrorFmt, err)
+	}
+	return nil
+}
+
+// tagValue replaces characters not allowed in tag values.
+func tagValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune(" +-=._:/@", r):
+			return r
+		}
+		return '-'
+	}, s)
+}
+
+// isErrorCode reports whether err is an AWS error with the given code.
+func isErrorCode(err error, code string) bool {
+	e, ok := err.(awserr.Error)
+	return ok && e.Code() == code
+}
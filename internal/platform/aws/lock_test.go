@@ -0,0 +1,39 @@
+// Copyright © 2018 Andrea Masi <eraclitux@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package aws
+
+import "testing"
+
+func Test_tagValue(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"ecsundo cluster", "ecsundo cluster"},
+		{"alice@laptop (pid 42)", "alice@laptop -pid 42-"},
+		{"2026-10-17T10:00:00Z", "2026-10-17T10:00:00Z"},
+	}
+	for _, tt := range tests {
+		if got := tagValue(tt.in); got != tt.want {
+			t.Errorf("tagValue(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -22,21 +22,403 @@ package aws
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
 )
 
 // nameFromARN returns resource name from an ARN in the form
-// arn:partition:service:region:account-id:resourcetype/resource
+// arn:partition:service:region:account-id:resourcetype/resource or, as for
+// services in the long ARN format, resourcetype/parent/resource.
 func nameFromARN(ARN string) string {
-	name := ""
 	tokens := strings.Split(ARN, "/")
-	if len(tokens) >= 2 {
-		name = tokens[1]
+	if len(tokens) < 2 {
+		return ""
+	}
+	return tokens[len(tokens)-1]
+}
+
+// TaskName returns the family:revision name of a task definition given
+// either as ARN or as name.
+func TaskName(taskDefinition string) string {
+	if name := nameFromARN(taskDefinition); name != "" {
+		return name
+	}
+	return taskDefinition
+}
+
+// ServiceName returns the name of a service given either its name or its ARN.
+func ServiceName(service string) string {
+	if name := nameFromARN(service); name != "" {
+		return name
+	}
+	return service
+}
+
+// serviceState returns the state of the primary deployment of a service.
+func serviceState(service *ecs.Service) ServiceState {
+	state := ServiceState{
+		ARN:         aws.StringValue(service.ServiceArn),
+		Deployments: len(service.Deployments),
+	}
+	for _, d := range service.Deployments {
+		if aws.StringValue(d.Status) != "PRIMARY" {
+			continue
+		}
+		state.TaskARN = aws.StringValue(d.TaskDefinition)
+		state.RolloutState = aws.StringValue(d.RolloutState)
+		state.RolloutStateReason = aws.StringValue(d.RolloutStateReason)
+		state.Running = aws.Int64Value(d.RunningCount)
+		state.Desired = aws.Int64Value(d.DesiredCount)
+	}
+	return state
+}
+
+// deploymentReport describes a service with a deployment in progress.
+func deploymentReport(state ServiceState) string {
+	report := fmt.Sprintf("%q: %d deployments, %d/%d tasks running", ServiceName(state.ARN), state.Deployments, state.Running, state.Desired)
+	if state.RolloutState != "" {
+		report += ", primary " + state.RolloutState
+	}
+	return report
+}
+
+// deploymentHistory returns distinct task ARNs of deployments, newest first,
+// made before the current task definition was first deployed. Versions
+// deployed after it, as the one a rollback to it replaced, are not previous
+// ones.
+func deploymentHistory(deployments []deployment, currentARN string) []string {
+	for i := len(deployments) - 1; i >= 0; i-- {
+		if deployments[i].TaskARN == currentARN {
+			deployments = deployments[i+1:]
+			break
+		}
+	}
+	seen := map[string]bool{currentARN: true}
+	taskARNs := make([]string, 0, len(deployments))
+	for _, d := range deployments {
+		if !seen[d.TaskARN] {
+			seen[d.TaskARN] = true
+			taskARNs = append(taskARNs, d.TaskARN)
+		}
+	}
+	return taskARNs
+}
+
+// matchName reports whether a service name is selected by filter patterns.
+func (f ServiceFilter) matchName(name string) (bool, error) {
+	for _, pattern := range f.Exclude {
+		ok, err := matchPattern(pattern, name)
+		if err != nil || ok {
+			return false, err
+		}
+	}
+	if len(f.Include) == 0 {
+		return true, nil
+	}
+	for _, pattern := range f.Include {
+		ok, err := matchPattern(pattern, name)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// matchPattern reports whether name matches a glob pattern or, if the
+// pattern is enclosed in slashes, a regular expression.
+func matchPattern(pattern, name string) (bool, error) {
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return false, fmt.Errorf("invalid pattern %q: %s", pattern, err)
+		}
+		return re.MatchString(name), nil
+	}
+	ok, err := path.Match(pattern, name)
+	if err != nil {
+		return false, fmt.Errorf("invalid pattern %q: %s", pattern, err)
+	}
+	return ok, nil
+}
+
+// dependencyLevels splits services in levels so that every service comes
+// after the services it depends on, directly or through services not being
+// changed. Names are compared ignoring case, as keys in configuration are.
+// An error is returned if dependencies have a cycle.
+func dependencyLevels(servicesInfo []ServiceInfo, dependsOn map[string][]string) ([][]ServiceInfo, error) {
+	graph := make(map[string][]string, len(dependsOn))
+	names := make([]string, 0, len(dependsOn))
+	for service, deps := range dependsOn {
+		name := strings.ToLower(service)
+		names = append(names, name)
+		for _, dep := range deps {
+			graph[name] = append(graph[name], strings.ToLower(dep))
+		}
+	}
+	// Sorted to report always the same cycle.
+	sort.Strings(names)
+	const visiting = -1
+	depth := make(map[string]int, len(graph))
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		if d, ok := depth[name]; ok {
+			if d != visiting {
+				return nil
+			}
+			for i := range path {
+				if path[i] == name {
+					return fmt.Errorf("dependency cycle: %s", strings.Join(append(path[i:], name), " -> "))
+				}
+			}
+		}
+		depth[name] = visiting
+		path = append(path[:len(path):len(path)], name)
+		level := 0
+		for _, dep := range graph[name] {
+			if err := visit(dep, path); err != nil {
+				return err
+			}
+			if depth[dep]+1 > level {
+				level = depth[dep] + 1
+			}
+		}
+		depth[name] = level
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	var levels [][]ServiceInfo
+	for _, service := range servicesInfo {
+		d := depth[strings.ToLower(ServiceName(service.ARN))]
+		for len(levels) <= d {
+			levels = append(levels, nil)
+		}
+		levels[d] = append(levels[d], service)
+	}
+	// Levels of services not being changed are dropped.
+	compacted := levels[:0]
+	for _, level := range levels {
+		if len(level) > 0 {
+			compacted = append(compacted, level)
+		}
+	}
+	return compacted, nil
+}
+
+// unknownDependencies returns, sorted, names in dependencies that are not
+// among the given service names. Names are compared ignoring case.
+func unknownDependencies(serviceNames []string, dependsOn map[string][]string) []string {
+	known := make(map[string]bool, len(serviceNames))
+	for _, name := range serviceNames {
+		known[strings.ToLower(name)] = true
+	}
+	unknown := make(map[string]bool)
+	for service, deps := range dependsOn {
+		for _, name := range append([]string{service}, deps...) {
+			if !known[strings.ToLower(name)] {
+				unknown[name] = true
+			}
+		}
+	}
+	names := make([]string, 0, len(unknown))
+	for name := range unknown {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// splitWaves splits services in waves: services of each group, in the given
+// order, then services not in any group. Waves have at most batchSize
+// services if it is positive.
+func splitWaves(servicesInfo []ServiceInfo, groups []ServiceGroup, batchSize int) ([][]ServiceInfo, error) {
+	assigned := make([]bool, len(servicesInfo))
+	grouped := make([][]ServiceInfo, 0, len(groups)+1)
+	for _, group := range groups {
+		var members []ServiceInfo
+		for i, service := range servicesInfo {
+			if assigned[i] {
+				continue
+			}
+			for _, pattern := range group.Services {
+				ok, err := matchPattern(pattern, ServiceName(service.ARN))
+				if err != nil {
+					return nil, fmt.Errorf("group %q: %s", group.Name, err)
+				}
+				if ok {
+					members = append(members, service)
+					assigned[i] = true
+					break
+				}
+			}
+		}
+		if len(members) > 0 {
+			grouped = append(grouped, members)
+		}
+	}
+	var rest []ServiceInfo
+	for i, service := range servicesInfo {
+		if !assigned[i] {
+			rest = append(rest, service)
+		}
+	}
+	if len(rest) > 0 {
+		grouped = append(grouped, rest)
+	}
+	if batchSize <= 0 {
+		return grouped, nil
+	}
+	waves := make([][]ServiceInfo, 0, len(grouped))
+	for _, services := range grouped {
+		for len(services) > batchSize {
+			waves = append(waves, services[:batchSize])
+			services = services[batchSize:]
+		}
+		waves = append(waves, services)
+	}
+	return waves, nil
+}
+
+// hasTags reports whether tags include all the wanted ones.
+func hasTags(tags []*ecs.Tag, wanted map[string]string) bool {
+	found := 0
+	for _, tag := range tags {
+		if value, ok := wanted[aws.StringValue(tag.Key)]; ok && value == aws.StringValue(tag.Value) {
+			found++
+		}
+	}
+	return found == len(wanted)
+}
+
+// registerInputFrom returns the input to register a new task definition
+// with the same configuration of the given one.
+func registerInputFrom(taskDef *ecs.TaskDefinition) *ecs.RegisterTaskDefinitionInput {
+	return &ecs.RegisterTaskDefinitionInput{
+		ContainerDefinitions:    taskDef.ContainerDefinitions,
+		Cpu:                     taskDef.Cpu,
+		EphemeralStorage:        taskDef.EphemeralStorage,
+		ExecutionRoleArn:        taskDef.ExecutionRoleArn,
+		Family:                  taskDef.Family,
+		InferenceAccelerators:   taskDef.InferenceAccelerators,
+		IpcMode:                 taskDef.IpcMode,
+		Memory:                  taskDef.Memory,
+		NetworkMode:             taskDef.NetworkMode,
+		PidMode:                 taskDef.PidMode,
+		PlacementConstraints:    taskDef.PlacementConstraints,
+		ProxyConfiguration:      taskDef.ProxyConfiguration,
+		RequiresCompatibilities: taskDef.RequiresCompatibilities,
+		RuntimePlatform:         taskDef.RuntimePlatform,
+		TaskRoleArn:             taskDef.TaskRoleArn,
+		Volumes:                 taskDef.Volumes,
+	}
+}
+
+// withContainerFrom returns the input to register a task definition like
+// taskDef, but with image and optionally environment of a container taken
+// from source.
+func withContainerFrom(taskDef, source *ecs.TaskDefinition, containerName string, withEnv bool) (*ecs.RegisterTaskDefinitionInput, error) {
+	var sourceContainer *ecs.ContainerDefinition
+	for _, c := range source.ContainerDefinitions {
+		if aws.StringValue(c.Name) == containerName {
+			sourceContainer = c
+		}
+	}
+	if sourceContainer == nil {
+		return nil, fmt.Errorf("container %q not found in %s", containerName, nameFromARN(aws.StringValue(source.TaskDefinitionArn)))
+	}
+	input := registerInputFrom(taskDef)
+	containers := make([]*ecs.ContainerDefinition, 0, len(taskDef.ContainerDefinitions))
+	found := false
+	for _, c := range taskDef.ContainerDefinitions {
+		if aws.StringValue(c.Name) == containerName {
+			container := *c
+			container.Image = sourceContainer.Image
+			if withEnv {
+				container.Environment = sourceContainer.Environment
+				container.EnvironmentFiles = sourceContainer.EnvironmentFiles
+			}
+			c = &container
+			found = true
+		}
+		containers = append(containers, c)
+	}
+	if !found {
+		return nil, fmt.Errorf("container %q not found in %s", containerName, nameFromARN(aws.StringValue(taskDef.TaskDefinitionArn)))
+	}
+	input.ContainerDefinitions = containers
+	return input, nil
+}
+
+// taskFingerprint returns a string identifying the configuration of a task
+// definition, regardless of its revision, status or tags.
+func taskFingerprint(taskDef *ecs.TaskDefinition) string {
+	b, _ := json.Marshal(registerInputFrom(taskDef))
+	return string(b)
+}
+
+// parseTaskDefinition returns family and revision from a task definition
+// reference in the form family:revision or from its full ARN.
+func parseTaskDefinition(taskDefinition string) (string, int, error) {
+	if strings.HasPrefix(taskDefinition, "arn:") {
+		taskDefinition = nameFromARN(taskDefinition)
+	}
+	i := strings.LastIndex(taskDefinition, ":")
+	if i <= 0 {
+		return "", 0, fmt.Errorf("invalid task definition %q", taskDefinition)
+	}
+	revision, err := strconv.Atoi(taskDefinition[i+1:])
+	if err != nil || revision <= 0 {
+		return "", 0, fmt.Errorf("invalid revision in task definition %q", taskDefinition)
+	}
+	return taskDefinition[:i], revision, nil
+}
+
+// How a container image matches a reference.
+const (
+	noMatch = iota
+	// partialMatch is a reference found in the tag or digest.
+	partialMatch
+	// exactMatch is a reference equal to the tag or digest.
+	exactMatch
+)
+
+// imageMatch returns how a container image matches a reference by tag or
+// digest. Registry and repository are not matched.
+func imageMatch(image, ref string) int {
+	if ref == "" {
+		return noMatch
+	}
+	var digest string
+	if i := strings.LastIndex(image, "@"); i >= 0 {
+		digest = image[i+1:]
+		image = image[:i]
+	}
+	var tag string
+	// Skip the registry part that may contain a port.
+	name := image[strings.LastIndex(image, "/")+1:]
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		tag = name[i+1:]
+	}
+	switch {
+	case tag == ref, digest != "" && (digest == ref || strings.TrimPrefix(digest, "sha256:") == ref):
+		return exactMatch
+	case strings.Contains(tag, ref), strings.Contains(digest, ref):
+		return partialMatch
 	}
-	return name
+	return noMatch
 }
 
 // getRegion tries to retrieve region from EC2 metadata.
@@ -24,7 +24,13 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
 )
 
 func Test_nameFromARN(t *testing.T) {
@@ -37,8 +43,12 @@ func Test_nameFromARN(t *testing.T) {
 			want: "resource-name",
 		},
 		{
-			arn:  "arn:partition:service:region:account-id:resourcetype/resource-name/qualifier",
-			want: "resource-name",
+			arn:  "arn:aws:ecs:us-east-1:123456789012:service/my-cluster/my-service",
+			want: "my-service",
+		},
+		{
+			arn:  "arn:aws:ecs:us-east-1:123456789012:task-definition/my-task:12",
+			want: "my-task:12",
 		},
 		{
 			arn:  "arn:partition:service:region:account-id:resource",
@@ -56,6 +66,272 @@ func Test_nameFromARN(t *testing.T) {
 	}
 }
 
+func TestTaskName(t *testing.T) {
+	tests := []struct {
+		taskDefinition string
+		want           string
+	}{
+		{
+			taskDefinition: "arn:aws:ecs:us-east-1:123456789012:task-definition/my-task:12",
+			want:           "my-task:12",
+		},
+		{
+			taskDefinition: "my-task:12",
+			want:           "my-task:12",
+		},
+	}
+	for _, tt := range tests {
+		if got := TaskName(tt.taskDefinition); got != tt.want {
+			t.Errorf("TaskName() = %v, want %v", got, tt.want)
+		}
+	}
+}
+
+func Test_parseTaskDefinition(t *testing.T) {
+	tests := []struct {
+		taskDefinition string
+		family         string
+		revision       int
+		wantErr        bool
+	}{
+		{
+			taskDefinition: "arn:aws:ecs:us-east-1:123456789012:task-definition/my-family:42",
+			family:         "my-family",
+			revision:       42,
+		},
+		{
+			taskDefinition: "my-family:7",
+			family:         "my-family",
+			revision:       7,
+		},
+		{
+			taskDefinition: "my-family",
+			wantErr:        true,
+		},
+		{
+			taskDefinition: "my-family:latest",
+			wantErr:        true,
+		},
+		{
+			taskDefinition: ":3",
+			wantErr:        true,
+		},
+	}
+	for _, tt := range tests {
+		family, revision, err := parseTaskDefinition(tt.taskDefinition)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTaskDefinition(%q) error = %v, wantErr %v", tt.taskDefinition, err, tt.wantErr)
+			continue
+		}
+		if family != tt.family || revision != tt.revision {
+			t.Errorf("parseTaskDefinition(%q) = %s, %d, want %s, %d", tt.taskDefinition, family, revision, tt.family, tt.revision)
+		}
+	}
+}
+
+func Test_imageMatch(t *testing.T) {
+	tests := []struct {
+		image string
+		ref   string
+		want  int
+	}{
+		{"123456789012.dkr.ecr.us-east-1.amazonaws.com/app:abc123", "abc123", exactMatch},
+		{"registry.local:5000/app:v1.2.0-abc123", "abc123", partialMatch},
+		{"app@sha256:deadbeef", "sha256:deadbeef", exactMatch},
+		{"app@sha256:deadbeef", "deadbeef", exactMatch},
+		{"app@sha256:deadbeef", "dead", partialMatch},
+		{"app:v1@sha256:deadbeef", "v1", exactMatch},
+		{"app:def456", "abc123", noMatch},
+		{"app:def456", "", noMatch},
+		// Registry and repository are not matched.
+		{"123456789012.dkr.ecr.us-east-1.amazonaws.com/app:abc123", "amazonaws", noMatch},
+		{"registry.local:5000/team/app:v1", "team", noMatch},
+		{"registry.local:5000/app", "5000", noMatch},
+	}
+	for _, tt := range tests {
+		if got := imageMatch(tt.image, tt.ref); got != tt.want {
+			t.Errorf("imageMatch(%q, %q) = %v, want %v", tt.image, tt.ref, got, tt.want)
+		}
+	}
+}
+
+func Test_deploymentHistory(t *testing.T) {
+	now := time.Now()
+	current := "arn:aws:ecs:us-east-1:123456789012:task-definition/app:10"
+	deployments := []deployment{
+		{TaskARN: current, At: now},
+		{TaskARN: "arn:aws:ecs:us-east-1:123456789012:task-definition/app:8", At: now.Add(-time.Hour)},
+		{TaskARN: "arn:aws:ecs:us-east-1:123456789012:task-definition/app:6", At: now.Add(-2 * time.Hour)},
+		{TaskARN: "arn:aws:ecs:us-east-1:123456789012:task-definition/app:8", At: now.Add(-3 * time.Hour)},
+	}
+	want := []string{
+		"arn:aws:ecs:us-east-1:123456789012:task-definition/app:8",
+		"arn:aws:ecs:us-east-1:123456789012:task-definition/app:6",
+	}
+	got := deploymentHistory(deployments, current)
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("deploymentHistory() = %v, want %v", got, want)
+	}
+	if got := deploymentHistory(deployments[:1], current); len(got) != 0 {
+		t.Errorf("deploymentHistory() = %v, want empty", got)
+	}
+	// app:10 has been deployed again rolling back app:11.
+	rolledBack := []deployment{
+		{TaskARN: current, At: now},
+		{TaskARN: "arn:aws:ecs:us-east-1:123456789012:task-definition/app:11", At: now.Add(-time.Hour)},
+		{TaskARN: current, At: now.Add(-2 * time.Hour)},
+		{TaskARN: "arn:aws:ecs:us-east-1:123456789012:task-definition/app:9", At: now.Add(-3 * time.Hour)},
+	}
+	want = []string{"arn:aws:ecs:us-east-1:123456789012:task-definition/app:9"}
+	if got := deploymentHistory(rolledBack, current); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("deploymentHistory() after rollback = %v, want %v", got, want)
+	}
+}
+
+func Test_serviceState(t *testing.T) {
+	deployment := func(status, rolloutState string, running int64) *ecs.Deployment {
+		d := &ecs.Deployment{
+			Status:       aws.String(status),
+			RunningCount: aws.Int64(running),
+			DesiredCount: aws.Int64(2),
+		}
+		if rolloutState != "" {
+			d.RolloutState = aws.String(rolloutState)
+		}
+		return d
+	}
+	tests := []struct {
+		name        string
+		deployments []*ecs.Deployment
+		stable      bool
+		failed      bool
+		inProgress  bool
+	}{
+		{"completed", []*ecs.Deployment{deployment("PRIMARY", "COMPLETED", 2)}, true, false, false},
+		{"starting tasks", []*ecs.Deployment{deployment("PRIMARY", "COMPLETED", 1)}, false, false, false},
+		{"in progress", []*ecs.Deployment{deployment("PRIMARY", "IN_PROGRESS", 2), deployment("ACTIVE", "COMPLETED", 2)}, false, false, true},
+		{"circuit breaker", []*ecs.Deployment{deployment("PRIMARY", "FAILED", 0), deployment("ACTIVE", "COMPLETED", 2)}, false, true, false},
+		{"no rollout state", []*ecs.Deployment{deployment("PRIMARY", "", 2)}, true, false, false},
+		{"no rollout state, draining", []*ecs.Deployment{deployment("PRIMARY", "", 2), deployment("ACTIVE", "", 1)}, false, false, true},
+	}
+	for _, tt := range tests {
+		state := serviceState(&ecs.Service{Deployments: tt.deployments})
+		if got := state.Stable(); got != tt.stable {
+			t.Errorf("%s: Stable() = %v, want %v", tt.name, got, tt.stable)
+		}
+		if got := state.Failed(); got != tt.failed {
+			t.Errorf("%s: Failed() = %v, want %v", tt.name, got, tt.failed)
+		}
+		if got := state.InProgress(); got != tt.inProgress {
+			t.Errorf("%s: InProgress() = %v, want %v", tt.name, got, tt.inProgress)
+		}
+	}
+}
+
+func Test_taskFingerprint(t *testing.T) {
+	newTaskDef := func(revision int64, image string) *ecs.TaskDefinition {
+		return &ecs.TaskDefinition{
+			Family:            aws.String("app"),
+			Revision:          aws.Int64(revision),
+			TaskDefinitionArn: aws.String(fmt.Sprintf("arn:aws:ecs:us-east-1:123456789012:task-definition/app:%d", revision)),
+			Status:            aws.String("ACTIVE"),
+			ContainerDefinitions: []*ecs.ContainerDefinition{
+				{Name: aws.String("app"), Image: aws.String(image)},
+			},
+		}
+	}
+	if taskFingerprint(newTaskDef(1, "app:abc")) != taskFingerprint(newTaskDef(2, "app:abc")) {
+		t.Error("same configuration must have the same fingerprint")
+	}
+	if taskFingerprint(newTaskDef(1, "app:abc")) == taskFingerprint(newTaskDef(2, "app:def")) {
+		t.Error("different configurations must have different fingerprints")
+	}
+}
+
+func Test_withContainerFrom(t *testing.T) {
+	newTaskDef := func(revision int64, appImage, envoyImage, logLevel string) *ecs.TaskDefinition {
+		return &ecs.TaskDefinition{
+			Family:            aws.String("app"),
+			TaskDefinitionArn: aws.String(fmt.Sprintf("arn:aws:ecs:us-east-1:123456789012:task-definition/app:%d", revision)),
+			ContainerDefinitions: []*ecs.ContainerDefinition{
+				{
+					Name:        aws.String("app"),
+					Image:       aws.String(appImage),
+					Environment: []*ecs.KeyValuePair{{Name: aws.String("LOG_LEVEL"), Value: aws.String(logLevel)}},
+				},
+				{Name: aws.String("envoy"), Image: aws.String(envoyImage)},
+			},
+		}
+	}
+	current := newTaskDef(3, "app:new", "envoy:v2", "info")
+	source := newTaskDef(2, "app:old", "envoy:v1", "debug")
+	input, err := withContainerFrom(current, source, "app", false)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	app, envoy := input.ContainerDefinitions[0], input.ContainerDefinitions[1]
+	if *app.Image != "app:old" || *envoy.Image != "envoy:v2" {
+		t.Fatalf("wrong images: %s, %s", *app.Image, *envoy.Image)
+	}
+	if *app.Environment[0].Value != "info" {
+		t.Fatal("environment must not change:", *app.Environment[0].Value)
+	}
+	if *current.ContainerDefinitions[0].Image != "app:new" {
+		t.Fatal("current task definition modified")
+	}
+	input, err = withContainerFrom(current, source, "app", true)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if *input.ContainerDefinitions[0].Environment[0].Value != "debug" {
+		t.Fatal("environment not taken from source")
+	}
+	if _, err := withContainerFrom(current, source, "datadog", false); err == nil {
+		t.Fatal("expected error for missing container")
+	}
+}
+
+func TestServiceFilter_matchName(t *testing.T) {
+	tests := []struct {
+		filter  ServiceFilter
+		name    string
+		want    bool
+		wantErr bool
+	}{
+		{filter: ServiceFilter{}, name: "api", want: true},
+		{filter: ServiceFilter{Include: []string{"api-*"}}, name: "api-users", want: true},
+		{filter: ServiceFilter{Include: []string{"api-*"}}, name: "web", want: false},
+		{filter: ServiceFilter{Include: []string{"/^(api|web)$/"}}, name: "web", want: true},
+		{filter: ServiceFilter{Exclude: []string{"datadog*"}}, name: "datadog-agent", want: false},
+		{filter: ServiceFilter{Include: []string{"*"}, Exclude: []string{"/agent/"}}, name: "log-agent", want: false},
+		{filter: ServiceFilter{Include: []string{"/(/"}}, name: "api", wantErr: true},
+		{filter: ServiceFilter{Exclude: []string{"[a-"}}, name: "api", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := tt.filter.matchName(tt.name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("matchName(%q) with %+v error = %v, wantErr %v", tt.name, tt.filter, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("matchName(%q) with %+v = %v, want %v", tt.name, tt.filter, got, tt.want)
+		}
+	}
+}
+
+func Test_hasTags(t *testing.T) {
+	tags := []*ecs.Tag{
+		{Key: aws.String("team"), Value: aws.String("payments")},
+		{Key: aws.String("env"), Value: aws.String("prod")},
+	}
+	if !hasTags(tags, map[string]string{"team": "payments"}) {
+		t.Error("expected tags to match")
+	}
+	if hasTags(tags, map[string]string{"team": "payments", "tier": "infra"}) {
+		t.Error("expected tags not to match")
+	}
+}
+
 func Test_getRegion(t *testing.T) {
 	validRegion := "us-east-1"
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -88,3 +364,122 @@ func Test_getRegion(t *testing.T) {
 		t.Fatalf("got: %s, expected: %s\n", region, validRegion)
 	}
 }
+
+// testServices returns services with the given names, with ARNs in the long
+// format including the cluster name.
+func testServices(names ...string) []ServiceInfo {
+	servicesInfo := make([]ServiceInfo, 0, len(names))
+	for _, name := range names {
+		servicesInfo = append(servicesInfo, ServiceInfo{ARN: "arn:aws:ecs:us-east-1:123456789012:service/prod/" + name})
+	}
+	return servicesInfo
+}
+
+// serviceNames returns the names of services, grouped as given.
+func serviceNames(groups [][]ServiceInfo) [][]string {
+	var out [][]string
+	for _, group := range groups {
+		var names []string
+		for _, s := range group {
+			names = append(names, ServiceName(s.ARN))
+		}
+		out = append(out, names)
+	}
+	return out
+}
+
+func Test_splitWaves(t *testing.T) {
+	servicesInfo := testServices("api", "web", "db-proxy", "worker", "api-admin", "cron")
+	groups := []ServiceGroup{
+		{Name: "data", Services: []string{"db-*"}},
+		{Name: "backend", Services: []string{"api*", "worker"}},
+		{Name: "empty"},
+	}
+	tests := []struct {
+		name      string
+		groups    []ServiceGroup
+		batchSize int
+		want      [][]string
+	}{
+		{"no waves", nil, 0, [][]string{{"api", "web", "db-proxy", "worker", "api-admin", "cron"}}},
+		{"batches", nil, 4, [][]string{{"api", "web", "db-proxy", "worker"}, {"api-admin", "cron"}}},
+		{"groups", groups, 0, [][]string{{"db-proxy"}, {"api", "worker", "api-admin"}, {"web", "cron"}}},
+		{"groups and batches", groups, 2, [][]string{{"db-proxy"}, {"api", "worker"}, {"api-admin"}, {"web", "cron"}}},
+		// Services have long ARNs, groups match names and not the cluster.
+		{"cluster name", []ServiceGroup{{Name: "cluster", Services: []string{"prod"}}}, 0, [][]string{{"api", "web", "db-proxy", "worker", "api-admin", "cron"}}},
+		{"exact names", []ServiceGroup{{Name: "web", Services: []string{"web", "cron"}}}, 0, [][]string{{"web", "cron"}, {"api", "db-proxy", "worker", "api-admin"}}},
+	}
+	for _, tt := range tests {
+		waves, err := splitWaves(servicesInfo, tt.groups, tt.batchSize)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", tt.name, err)
+		}
+		if got := serviceNames(waves); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: splitWaves() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if _, err := splitWaves(servicesInfo, []ServiceGroup{{Name: "bad", Services: []string{"/[/"}}}, 0); err == nil {
+		t.Error("expected error for invalid pattern")
+	}
+}
+
+func Test_dependencyLevels(t *testing.T) {
+	servicesInfo := testServices("web", "api", "Worker", "db-proxy", "cron")
+	tests := []struct {
+		name      string
+		dependsOn map[string][]string
+		want      [][]string
+		wantErr   string
+	}{
+		{
+			name: "no dependencies",
+			want: [][]string{{"web", "api", "Worker", "db-proxy", "cron"}},
+		},
+		{
+			name:      "chain",
+			dependsOn: map[string][]string{"web": {"api"}, "api": {"db-proxy"}, "worker": {"db-proxy"}},
+			want:      [][]string{{"db-proxy", "cron"}, {"api", "Worker"}, {"web"}},
+		},
+		{
+			name:      "through services not changed",
+			dependsOn: map[string][]string{"web": {"gateway"}, "gateway": {"api"}},
+			want:      [][]string{{"api", "Worker", "db-proxy", "cron"}, {"web"}},
+		},
+		{
+			name:      "cycle",
+			dependsOn: map[string][]string{"web": {"api"}, "api": {"worker"}, "worker": {"web"}},
+			wantErr:   "dependency cycle: api -> worker -> web -> api",
+		},
+	}
+	for _, tt := range tests {
+		levels, err := dependencyLevels(servicesInfo, tt.dependsOn)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", tt.name, err)
+		}
+		if got := serviceNames(levels); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: dependencyLevels() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func Test_unknownDependencies(t *testing.T) {
+	names := []string{"web", "api", "Worker", "db-proxy"}
+	dependsOn := map[string][]string{
+		"web":    {"api", "gateway"},
+		"worker": {"DB-proxy"},
+		"cron":   {"api"},
+	}
+	want := []string{"cron", "gateway"}
+	if got := unknownDependencies(names, dependsOn); !reflect.DeepEqual(got, want) {
+		t.Errorf("unknownDependencies() = %v, want %v", got, want)
+	}
+	if got := unknownDependencies(names, nil); len(got) != 0 {
+		t.Errorf("unknownDependencies() without dependencies = %v", got)
+	}
+}